@@ -0,0 +1,126 @@
+package coco
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL decides which addresses Listen accepts collectd packets from, and which
+// addresses may send samples for a host.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	hosts map[string][]*net.IPNet
+}
+
+// parseCIDRs parses a list of CIDRs. Bare addresses are taken to be a
+// single host.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// NewACL builds an ACL from the allow, deny, and host_cidrs options in
+// [listen]. Hosts in host_cidrs are normalised, so they match the normalised
+// hostnames HostAllowed is given.
+func NewACL(config ListenConfig, normaliser *Normaliser) (*ACL, error) {
+	acl := &ACL{hosts: map[string][]*net.IPNet{}}
+	var err error
+	if acl.allow, err = parseCIDRs(config.Allow); err != nil {
+		return nil, fmt.Errorf("invalid allow: %s", err)
+	}
+	if acl.deny, err = parseCIDRs(config.Deny); err != nil {
+		return nil, fmt.Errorf("invalid deny: %s", err)
+	}
+	for host, cidrs := range config.HostCIDRs {
+		if acl.hosts[normaliser.Hostname(host)], err = parseCIDRs(cidrs); err != nil {
+			return nil, fmt.Errorf("invalid host_cidrs for %s: %s", host, err)
+		}
+	}
+
+	// Initialise the rejection counts
+	for _, n := range acl.deny {
+		listenCounts.Add("acl.deny."+n.String(), 0)
+	}
+	if len(acl.allow) > 0 {
+		listenCounts.Add("acl.not_allowed", 0)
+	}
+	for host := range acl.hosts {
+		listenCounts.Add("acl.host."+host, 0)
+	}
+	return acl, nil
+}
+
+// contains checks if any of the networks contain ip, and returns the first
+// that does.
+func contains(nets []*net.IPNet, ip net.IP) (*net.IPNet, bool) {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// Allowed checks if packets from an address are accepted. Deny rules are
+// checked first, then if there are any allow rules, the address must match
+// one of them. Rejections are counted by the rule that rejected them.
+func (acl *ACL) Allowed(ip net.IP) bool {
+	if n, ok := contains(acl.deny, ip); ok {
+		listenCounts.Add("acl.deny."+n.String(), 1)
+		return false
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	if _, ok := contains(acl.allow, ip); !ok {
+		listenCounts.Add("acl.not_allowed", 1)
+		return false
+	}
+	return true
+}
+
+// HostAllowed checks if an address may send samples for a host, given its
+// normalised hostname. Hosts that aren't bound to any CIDRs may be sent from
+// anywhere.
+func (acl *ACL) HostAllowed(host string, ip net.IP) bool {
+	nets, ok := acl.hosts[host]
+	if !ok {
+		return true
+	}
+	if _, ok := contains(nets, ip); !ok {
+		listenCounts.Add("acl.host."+host, 1)
+		return false
+	}
+	return true
+}
+
+// addrIP finds the IP address of a UDP or TCP address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
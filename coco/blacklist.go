@@ -0,0 +1,184 @@
+package coco
+
+import (
+	"sync"
+	"time"
+)
+
+// BlacklistEntry tracks the samples for a metric dropped by Filter.
+type BlacklistEntry struct {
+	Plugin string `json:"plugin"`
+	// The rule that dropped the most recent sample
+	Rule      string `json:"rule"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+	Hits      int64  `json:"hits"`
+}
+
+// BlacklistTotals counts the metrics dropped by Filter, and their samples.
+type BlacklistTotals struct {
+	Metrics int   `json:"metrics"`
+	Hits    int64 `json:"hits"`
+}
+
+// BlacklistSummary totals the metrics dropped by Filter, overall, per host,
+// and per rule.
+type BlacklistSummary struct {
+	Hosts int `json:"hosts"`
+	BlacklistTotals
+	ByHost map[string]BlacklistTotals `json:"by_host"`
+	ByRule map[string]BlacklistTotals `json:"by_rule"`
+}
+
+/*
+Blacklisted holds the metrics dropped by Filter, by host and metric name.
+
+Entries are removed once they haven't been seen for the blacklist TTL, so
+hosts and metrics that stop being dropped don't stay in the list forever.
+*/
+type Blacklisted struct {
+	mutex sync.Mutex
+	// map[host]map[metric name]entry
+	entries map[string]map[string]*BlacklistEntry
+}
+
+// NewBlacklisted sets up an empty list of dropped metrics.
+func NewBlacklisted() *Blacklisted {
+	return &Blacklisted{entries: make(map[string]map[string]*BlacklistEntry)}
+}
+
+// add records a dropped sample.
+func (b *Blacklisted) add(item BlacklistItem) {
+	packet := item.Packet
+	name := MetricName(packet)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.entries[packet.Hostname] == nil {
+		b.entries[packet.Hostname] = make(map[string]*BlacklistEntry)
+	}
+	entry := b.entries[packet.Hostname][name]
+	if entry == nil {
+		entry = &BlacklistEntry{Plugin: packet.Plugin, FirstSeen: item.Time}
+		b.entries[packet.Hostname][name] = entry
+	}
+	entry.Rule = item.Rule
+	entry.LastSeen = item.Time
+	entry.Hits++
+}
+
+// Expire removes entries last seen before a time, and returns how many were
+// removed.
+func (b *Blacklisted) Expire(before int64) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	expired := 0
+	for host, metrics := range b.entries {
+		for name, entry := range metrics {
+			if entry.LastSeen < before {
+				delete(metrics, name)
+				expired++
+			}
+		}
+		if len(metrics) == 0 {
+			delete(b.entries, host)
+		}
+	}
+	return expired
+}
+
+// each calls a function for every entry from a host and plugin, or from every
+// host or plugin if they're empty.
+func (b *Blacklisted) each(host string, plugin string, f func(host string, name string, entry BlacklistEntry)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for h, metrics := range b.entries {
+		if len(host) > 0 && h != host {
+			continue
+		}
+		for name, entry := range metrics {
+			if len(plugin) > 0 && entry.Plugin != plugin {
+				continue
+			}
+			f(h, name, *entry)
+		}
+	}
+}
+
+// Entries returns the entries from a host and plugin, or from every host or
+// plugin if they're empty.
+func (b *Blacklisted) Entries(host string, plugin string) map[string]map[string]BlacklistEntry {
+	result := make(map[string]map[string]BlacklistEntry)
+	b.each(host, plugin, func(h string, name string, entry BlacklistEntry) {
+		if result[h] == nil {
+			result[h] = make(map[string]BlacklistEntry)
+		}
+		result[h][name] = entry
+	})
+	return result
+}
+
+// LastSeen returns when each metric from a host and plugin was last dropped,
+// or from every host or plugin if they're empty.
+func (b *Blacklisted) LastSeen(host string, plugin string) map[string]map[string]int64 {
+	result := make(map[string]map[string]int64)
+	b.each(host, plugin, func(h string, name string, entry BlacklistEntry) {
+		if result[h] == nil {
+			result[h] = make(map[string]int64)
+		}
+		result[h][name] = entry.LastSeen
+	})
+	return result
+}
+
+// Summary totals the entries from a host and plugin, or from every host or
+// plugin if they're empty.
+func (b *Blacklisted) Summary(host string, plugin string) BlacklistSummary {
+	summary := BlacklistSummary{
+		ByHost: make(map[string]BlacklistTotals),
+		ByRule: make(map[string]BlacklistTotals),
+	}
+	b.each(host, plugin, func(h string, name string, entry BlacklistEntry) {
+		summary.Metrics++
+		summary.Hits += entry.Hits
+		totals := summary.ByHost[h]
+		totals.Metrics++
+		totals.Hits += entry.Hits
+		summary.ByHost[h] = totals
+		totals = summary.ByRule[entry.Rule]
+		totals.Metrics++
+		totals.Hits += entry.Hits
+		summary.ByRule[entry.Rule] = totals
+	})
+	summary.Hosts = len(summary.ByHost)
+	return summary
+}
+
+// minExpireInterval is the most often Blacklist checks for expired entries.
+const minExpireInterval = time.Second
+
+// Blacklist records the samples dropped by Filter, and expires entries that
+// haven't been seen for the blacklist TTL.
+func Blacklist(config FilterConfig, updates chan BlacklistItem, blacklisted *Blacklisted) {
+	// Initialise the counts
+	blacklistCounts.Add("expired", 0)
+
+	ttl := config.TTL()
+	// Check for expired entries a few times per TTL, but not too often
+	interval := ttl / 4
+	if interval < minExpireInterval {
+		interval = minExpireInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case item := <-updates:
+			blacklisted.add(item)
+		case now := <-ticker.C:
+			expired := blacklisted.Expire(now.Add(-ttl).Unix())
+			blacklistCounts.Add("expired", int64(expired))
+		}
+	}
+}
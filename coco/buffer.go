@@ -0,0 +1,88 @@
+package coco
+
+import (
+	"errors"
+	collectd "github.com/kimor79/gollectd"
+)
+
+// MaxPacketSize is collectd 5's default network buffer size. See:
+// https://collectd.org/wiki/index.php/Binary_protocol
+const MaxPacketSize = 1452
+
+// ErrBufferFull is returned when a sample doesn't fit in what's left of a
+// Buffer.
+var ErrBufferFull = errors.New("buffer is full")
+
+/*
+Buffer packs samples bound for a target into collectd packets, so many samples
+can be dispatched in a single datagram.
+
+Like collectd's network plugin, parts are only written when they differ from
+the previous sample in the buffer. A sample for the same host and plugin as the
+one before it will only add its time, interval, type, and values parts.
+*/
+type Buffer struct {
+	size    int
+	buf     []byte
+	last    collectd.Packet
+	samples int
+}
+
+// NewBuffer returns a Buffer that will hold up to size bytes of samples.
+func NewBuffer(size int) *Buffer {
+	return &Buffer{size: size, buf: make([]byte, 0, size)}
+}
+
+// Append encodes a sample into the buffer. It returns ErrBufferFull if the
+// sample doesn't fit, in which case the buffer should be flushed and the
+// sample appended again.
+func (b *Buffer) Append(packet collectd.Packet) error {
+	return b.AppendFrame(Frame{Packet: packet})
+}
+
+// AppendFrame encodes a sample into the buffer, like Append. If the frame
+// carries the values part it was received with, that part is copied into the
+// buffer as is, rather than being encoded from the sample's values.
+func (b *Buffer) AppendFrame(frame Frame) error {
+	buf, err := encodeMetadata(b.last, frame.Packet)
+	if err != nil {
+		return err
+	}
+	if frame.Values != nil {
+		buf = append(buf, frame.Values...)
+	} else {
+		buf, err = appendValues(buf, frame.Packet.Values)
+		if err != nil {
+			return err
+		}
+	}
+	if len(b.buf)+len(buf) > b.size {
+		return ErrBufferFull
+	}
+	b.buf = append(b.buf, buf...)
+	b.last = frame.Packet
+	b.samples++
+	return nil
+}
+
+// Bytes returns the encoded samples in the buffer.
+func (b *Buffer) Bytes() []byte {
+	return b.buf
+}
+
+// Len returns the number of bytes in the buffer.
+func (b *Buffer) Len() int {
+	return len(b.buf)
+}
+
+// Samples returns the number of samples in the buffer.
+func (b *Buffer) Samples() int {
+	return b.samples
+}
+
+// Reset empties the buffer, so the next sample is encoded in full.
+func (b *Buffer) Reset() {
+	b.buf = b.buf[:0]
+	b.last = collectd.Packet{}
+	b.samples = 0
+}
@@ -0,0 +1,199 @@
+package coco
+
+import (
+	collectd "github.com/kimor79/gollectd"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock skew outcomes, counted in coco.clock.
+const (
+	SkewStale     = "stale"
+	SkewFuture    = "future"
+	SkewDropped   = "dropped"
+	SkewRestamped = "restamped"
+)
+
+// ClockSkew tracks the samples from a host with timestamps outside the
+// acceptance window. Offsets are in seconds, negative for samples in the past.
+type ClockSkew struct {
+	Host string `json:"host"`
+	// Offset of the most recent sample outside the window
+	Offset float64 `json:"offset"`
+	// Largest offset seen, in either direction
+	WorstOffset float64 `json:"worst_offset"`
+	Stale       int64   `json:"stale"`
+	Future      int64   `json:"future"`
+	Dropped     int64   `json:"dropped"`
+	Restamped   int64   `json:"restamped"`
+	LastSeen    int64   `json:"last_seen"`
+}
+
+// maxSkewedHosts is the most hosts a SkewTracker keeps track of.
+const maxSkewedHosts = 1000
+
+/*
+SkewTracker keeps track of the hosts that have sent samples outside the
+acceptance window, for /clock-skew.
+
+At most maxSkewedHosts hosts are tracked. When it's full, the host with the
+smallest worst offset makes way for a host with a larger one, so the worst
+offenders are always listed.
+*/
+type SkewTracker struct {
+	mutex sync.Mutex
+	hosts map[string]*ClockSkew
+}
+
+// NewSkewTracker sets up an empty SkewTracker.
+func NewSkewTracker() *SkewTracker {
+	return &SkewTracker{hosts: make(map[string]*ClockSkew)}
+}
+
+// Worst returns up to limit hosts that have sent samples outside the
+// acceptance window, worst offset first.
+func (st *SkewTracker) Worst(limit int) []ClockSkew {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	var l []ClockSkew
+	for _, s := range st.hosts {
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return math.Abs(l[i].WorstOffset) > math.Abs(l[j].WorstOffset)
+	})
+	if limit > 0 && len(l) > limit {
+		l = l[:limit]
+	}
+	return l
+}
+
+// record counts a sample outside the acceptance window, and what was done with
+// it.
+func (st *SkewTracker) record(host string, offset float64, reason string, outcome string, now time.Time) {
+	clockCounts.Add(reason, 1)
+	clockCounts.Add(outcome, 1)
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	s, ok := st.hosts[host]
+	if !ok {
+		if len(st.hosts) >= maxSkewedHosts && !st.evict(offset) {
+			return
+		}
+		s = &ClockSkew{Host: host}
+		st.hosts[host] = s
+	}
+	s.Offset = offset
+	if math.Abs(offset) > math.Abs(s.WorstOffset) {
+		s.WorstOffset = offset
+	}
+	switch reason {
+	case SkewStale:
+		s.Stale++
+	case SkewFuture:
+		s.Future++
+	}
+	switch outcome {
+	case SkewDropped:
+		s.Dropped++
+	case SkewRestamped:
+		s.Restamped++
+	}
+	s.LastSeen = now.Unix()
+}
+
+// evict stops tracking the host with the smallest worst offset, if it's
+// smaller than offset, and returns whether a host was evicted.
+func (st *SkewTracker) evict(offset float64) bool {
+	var least *ClockSkew
+	for _, s := range st.hosts {
+		if least == nil || math.Abs(s.WorstOffset) < math.Abs(least.WorstOffset) {
+			least = s
+		}
+	}
+	if least == nil || math.Abs(least.WorstOffset) >= math.Abs(offset) {
+		return false
+	}
+	delete(st.hosts, least.Host)
+	return true
+}
+
+// sampleTime returns when a sample was taken, from its high resolution time if
+// it has one. collectd's high resolution times are in units of 2^-30 seconds.
+func sampleTime(packet collectd.Packet) (time.Time, bool) {
+	switch {
+	case packet.TimeHR > 0:
+		secs := packet.TimeHR >> 30
+		nsecs := (packet.TimeHR & (1<<30 - 1)) * uint64(time.Second) >> 30
+		return time.Unix(int64(secs), int64(nsecs)), true
+	case packet.Time > 0:
+		return time.Unix(int64(packet.Time), 0), true
+	}
+	return time.Time{}, false
+}
+
+// restamp sets a sample's time, in whichever resolution it was sent with.
+func restamp(packet *collectd.Packet, now time.Time) {
+	if packet.TimeHR > 0 {
+		packet.TimeHR = uint64(now.Unix())<<30 | uint64(now.Nanosecond())<<30/uint64(time.Second)
+	} else {
+		packet.Time = uint64(now.Unix())
+	}
+}
+
+/*
+CheckClock checks a sample's timestamp is within the acceptance window around
+now, and returns whether the sample should be kept.
+
+Samples older than max_age or further ahead than max_ahead are dropped, or
+stamped with now if restamp is set. Samples without a timestamp, and checks
+with no limit set, are always kept.
+*/
+func CheckClock(config ClockConfig, skews *SkewTracker, packet *collectd.Packet, now time.Time) bool {
+	t, ok := sampleTime(*packet)
+	if !ok {
+		return true
+	}
+	offset := t.Sub(now)
+
+	var reason string
+	switch {
+	case config.MaxAge.Duration > 0 && offset < -config.MaxAge.Duration:
+		reason = SkewStale
+	case config.MaxAhead.Duration > 0 && offset > config.MaxAhead.Duration:
+		reason = SkewFuture
+	default:
+		return true
+	}
+
+	if config.Restamp {
+		restamp(packet, now)
+		skews.record(packet.Hostname, offset.Seconds(), reason, SkewRestamped, now)
+		return true
+	}
+	skews.record(packet.Hostname, offset.Seconds(), reason, SkewDropped, now)
+	return false
+}
+
+// initClockCounts initialises the clock skew counts.
+func initClockCounts() {
+	for _, k := range []string{SkewStale, SkewFuture, SkewDropped, SkewRestamped} {
+		clockCounts.Add(k, 0)
+	}
+}
+
+// Clock takes samples from Relabel, drops or restamps those with timestamps
+// outside the acceptance window, and queues the rest for Filter.
+func Clock(config ClockConfig, skews *SkewTracker, in chan collectd.Packet, out chan collectd.Packet) {
+	initClockCounts()
+
+	for {
+		packet := <-in
+		if CheckClock(config, skews, &packet, time.Now()) {
+			out <- packet
+		}
+	}
+}
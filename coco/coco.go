@@ -1,19 +1,21 @@
 package coco
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"github.com/go-martini/martini"
 	collectd "github.com/kimor79/gollectd"
 	consistent "github.com/stathat/consistent"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -95,47 +97,150 @@ func Measure(config MeasureConfig, chans map[string]chan collectd.Packet, tiers
 	}
 }
 
-// Listen takes collectd network packets and breaks them into individual samples.
-func Listen(config ListenConfig, c chan collectd.Packet) {
-	// Initialise the error counts
-	errorCounts.Add("fetch.receive", 0)
-
-	laddr, err := net.ResolveUDPAddr("udp", config.Bind)
+// Listen takes collectd network packets and breaks them into individual samples
+// and notifications. Hostnames are normalised before they're checked against
+// host_cidrs, but samples are queued with the hostnames they were sent with, for
+// Normalise. Notifications skip Normalise, so they're queued normalised.
+// Samples are decoded with types, or with types.db loaded by Listen if it's nil.
+func Listen(config ListenConfig, normaliser *Normaliser, types *TypesDB, c chan collectd.Packet, notifications chan Notification) {
+	conns, err := listenUDP(config, config.readers())
 	if err != nil {
-		log.Fatalln("[fatal] Listen: failed to resolve address", err)
+		log.Fatalln("[fatal] Listen:", err)
 	}
+	go watchDrops(conns)
 
-	conn, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		log.Fatalln("[fatal] Listen: failed to listen", err)
+	// Initialise the unknown type counts
+	listenCounts.Add("unknown_types", 0)
+
+	if types == nil {
+		types, err = WatchTypesDB(config)
+		if err != nil {
+			log.Fatalln("[fatal] Listen: failed to parse types.db", err)
+		}
 	}
 
-	types, err := collectd.TypesDBFile(config.Typesdb)
+	acl, err := NewACL(config, normaliser)
 	if err != nil {
-		log.Fatalln("[fatal] Listen: failed to parse types.db", err)
+		log.Fatalln("[fatal] Listen:", err)
+	}
+
+	if len(config.TCP.Bind) > 0 {
+		go ListenTCP(config, acl, normaliser, types, c, notifications)
 	}
+	if len(config.Graphite.Bind) > 0 {
+		go ListenGraphite(config.Graphite, c)
+	}
+	if len(config.StatsD.Bind) > 0 {
+		go ListenStatsD(config.StatsD, c)
+	}
+	if len(config.InfluxDB.Bind) > 0 {
+		go ListenInfluxDB(config.InfluxDB, c)
+	}
+
+	// Each reader has its own socket, so the kernel spreads datagrams across them
+	for i, conn := range conns[1:] {
+		go read(config, acl, normaliser, conn, readerCount(i+1), types, c, notifications)
+	}
+	read(config, acl, normaliser, conns[0], readerCount(0), types, c, notifications)
+}
+
+// readerCount exports a count of the packets a reader has received, so it's
+// clear how the kernel is spreading packets across readers.
+func readerCount(reader int) *expvar.Int {
+	count := new(expvar.Int)
+	listenCounts.Set("reader."+strconv.Itoa(reader), count)
+	return count
+}
 
+// read receives collectd packets on a socket until it's closed.
+func read(config ListenConfig, acl *ACL, normaliser *Normaliser, conn *net.UDPConn, received *expvar.Int, types *TypesDB, c chan collectd.Packet, notifications chan Notification) {
 	for {
-		// 1452 is collectd 5's default buffer size. See:
-		// https://collectd.org/wiki/index.php/Binary_protocol
-		buf := make([]byte, 1452)
+		// Samples are decoded before the next read, so buffers can be reused
+		buf := packetBuffers.Get().([]byte)
 
-		n, err := conn.Read(buf[:])
+		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			packetBuffers.Put(buf)
 			log.Println("[error] Listen: Failed to receive packet", err)
 			errorCounts.Add("fetch.receive", 1)
 			continue
 		}
 		listenCounts.Add("raw", 1)
+		received.Add(1)
 
-		packets, err := collectd.Packets(buf[0:n], types)
-		for _, p := range *packets {
-			listenCounts.Add("decoded", 1)
-			c <- p
+		if !acl.Allowed(addr.IP) {
+			packetBuffers.Put(buf)
+			continue
+		}
+		receive(config, acl, normaliser, types.Types(), addr, buf[0:n], c, notifications)
+		packetBuffers.Put(buf)
+	}
+}
+
+// receive decodes a collectd packet into samples, and queues them for Filter.
+// Notifications are queued for Send, if there is somewhere to queue them.
+// Packets that can't be decoded are kept for /debug/malformed, but their
+// notifications are still queued. Samples with types that aren't in types.db are
+// tracked for /types/unknown. Samples and notifications for a host are dropped
+// if the source isn't bound to the host.
+func receive(config ListenConfig, acl *ACL, normaliser *Normaliser, types collectd.Types, source net.Addr, buf []byte, c chan collectd.Packet, notifications chan Notification) {
+	// Verify or decrypt the packet, if we need to
+	payload, err := Open(config, buf)
+	if err != nil {
+		return
+	}
+
+	packets, err := decode(payload, types)
+	if err != nil {
+		captureMalformed(source.String(), payload, err)
+	}
+	ip := addrIP(source)
+	for _, p := range packets {
+		listenCounts.Add("decoded", 1)
+		if !acl.HostAllowed(normaliser.Hostname(p.Hostname), ip) {
+			continue
+		}
+		if _, ok := types[p.Type]; !ok {
+			recordUnknownType(p)
+		}
+		c <- p
+	}
+
+	if notifications != nil {
+		ns, _ := Notifications(payload)
+		for _, n := range ns {
+			listenCounts.Add("notifications", 1)
+			n.Hostname = normaliser.Hostname(n.Hostname)
+			if !acl.HostAllowed(n.Hostname, ip) {
+				continue
+			}
+			notifications <- n
 		}
 	}
 }
 
+// listenUDP binds n sockets to the address collectd packets are sent to.
+func listenUDP(config ListenConfig, n int) ([]*net.UDPConn, error) {
+	// Initialise the error counts
+	errorCounts.Add("fetch.receive", 0)
+	errorCounts.Add("listen.security.unsigned", 0)
+	errorCounts.Add("listen.security.unknown_user", 0)
+	errorCounts.Add("listen.security.bad_signature", 0)
+	errorCounts.Add("listen.security.unencrypted", 0)
+	errorCounts.Add("listen.security.decrypt", 0)
+	errorCounts.Add("listen.decode.invalid", 0)
+	errorCounts.Add("listen.decode.unknown_type", 0)
+	errorCounts.Add("listen.decode.unsupported", 0)
+	errorCounts.Add("listen.decode.unknown_data_type", 0)
+	errorCounts.Add("listen.decode.other", 0)
+
+	if _, err := securityLevel(config.SecurityLevel); err != nil {
+		return nil, fmt.Errorf("invalid security level: %s", err)
+	}
+
+	return listenUDPSockets(config, n)
+}
+
 func MetricName(packet collectd.Packet) string {
 	prts := []string{
 		packet.Plugin,
@@ -155,7 +260,9 @@ func MetricName(packet collectd.Packet) string {
 	return strings.Join(parts, "/")
 }
 
-func Filter(config FilterConfig, raw chan collectd.Packet, filtered chan collectd.Packet, blacklist chan BlacklistItem) {
+// Filter checks samples against the filter rules, queueing the samples that
+// are allowed for Send, and those that aren't for Blacklist.
+func Filter(rules *RuleSet, raw chan collectd.Packet, filtered chan collectd.Packet, blacklist chan BlacklistItem) {
 	// Initialise the error counts
 	errorCounts.Add("filter.unhandled", 0)
 
@@ -168,38 +275,53 @@ func Filter(config FilterConfig, raw chan collectd.Packet, filtered chan collect
 
 	for {
 		packet := <-raw
-		name := MetricName(packet)
-		full := packet.Hostname + "/" + name
-
-		re := regexp.MustCompile(config.Blacklist)
-		if re.FindStringIndex(full) == nil {
+		// The rules can be swapped at any time, so they're loaded for every sample
+		if allowed, rule := rules.Rules().Allowed(packet); allowed {
 			filtered <- packet
 			filterCounts.Add("accepted", 1)
 		} else {
-			blacklist <- BlacklistItem{Packet: packet, Time: time.Now().Unix()}
+			blacklist <- BlacklistItem{Packet: packet, Time: time.Now().Unix(), Rule: rule.Name}
 			filterCounts.Add("rejected", 1)
 		}
 	}
 }
 
-func Blacklist(updates chan BlacklistItem, blacklisted *map[string]map[string]int64) {
-	for {
-		item := <-updates
-		packet := item.Packet
-		name := MetricName(item.Packet)
-		if (*blacklisted)[packet.Hostname] == nil {
-			(*blacklisted)[packet.Hostname] = make(map[string]int64)
-		}
-		(*blacklisted)[packet.Hostname][name] = item.Time
-	}
-}
-
 // BuildTiers sets up tiers so it's ready to dispatch metrics
 func BuildTiers(tiers *[]Tier) {
 	// Initialise the error counts
 	errorCounts.Add("buildtiers.dial", 0)
 
 	for i, tier := range *tiers {
+		// Check the tier can sign or encrypt what it dispatches
+		level, err := securityLevel(tier.SecurityLevel)
+		if err != nil {
+			log.Fatalf("[fatal] BuildTiers: tier '%s' has an %s", tier.Name, err)
+		}
+		if level != SecurityLevelNone && len(tier.Username) == 0 {
+			log.Fatalf("[fatal] BuildTiers: tier '%s' needs a username to %s packets", tier.Name, level)
+		}
+
+		// Compile the rules deciding which metrics the tier stores
+		(*tiers)[i].include = nil
+		for _, pattern := range tier.Include {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Fatalf("[fatal] BuildTiers: tier '%s' has an invalid include '%s': %s", tier.Name, pattern, err)
+			}
+			(*tiers)[i].include = append((*tiers)[i].include, re)
+		}
+		(*tiers)[i].exclude = nil
+		for _, pattern := range tier.Exclude {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Fatalf("[fatal] BuildTiers: tier '%s' has an invalid exclude '%s': %s", tier.Name, pattern, err)
+			}
+			(*tiers)[i].exclude = append((*tiers)[i].exclude, re)
+		}
+		excludedCounts.Add(tier.Name, 0)
+		limitCounts.Add(LimitHost, 0)
+		limitCounts.Add(LimitPlugin, 0)
+
 		// The consistent hashing function used to map sample hosts to targets
 		(*tiers)[i].Hash = consistent.New()
 		// Shadow names for targets, used to improve hash distribution
@@ -208,6 +330,10 @@ func BuildTiers(tiers *[]Tier) {
 		(*tiers)[i].Connections = make(map[string]net.Conn)
 		// map that tracks all target -> host -> metric -> last dispatched relationships
 		(*tiers)[i].Mappings = make(map[string]map[string]map[string]int64)
+		// map that tracks samples buffered for dispatch to each target
+		(*tiers)[i].Buffers = make(map[string]*Buffer)
+		// map that tracks the number of series for each host's plugins
+		(*tiers)[i].pluginSeries = make(map[seriesKey]int)
 		// Set the virtual replica number from magical pre-computed values
 		(*tiers)[i].SetMagicVirtualReplicaNumber(len(tier.Targets))
 
@@ -230,6 +356,8 @@ func BuildTiers(tiers *[]Tier) {
 			}
 			(*tiers)[i].Connections[t] = conn
 			(*tiers)[i].Mappings[t] = make(map[string]map[string]int64)
+			// Leave room in the packet to sign or encrypt the buffer
+			(*tiers)[i].Buffers[t] = NewBuffer(MaxPacketSize - (*tiers)[i].overhead())
 			// Setup a shadow mapping so we get a more even hash distribution
 			shadow_t := string(it)
 			(*tiers)[i].Shadows[shadow_t] = t
@@ -256,190 +384,290 @@ func BuildTiers(tiers *[]Tier) {
 	}
 }
 
-func Send(tiers *[]Tier, filtered chan collectd.Packet) {
+// Send distributes samples to the storage targets. Samples are buffered per
+// target, and dispatched when the buffer is full, or on every flush interval.
+func Send(config SendConfig, tiers *[]Tier, filtered chan collectd.Packet, notifications chan Notification) {
 	// Initialise the error counts
 	errorCounts.Add("send.write", 0)
 	errorCounts.Add("send.disconnected", 0)
+	errorCounts.Add("send.seal", 0)
+	errorCounts.Add("send.oversize", 0)
+	errorCounts.Add("send.encode", 0)
+	errorCounts.Add("send.webhook", 0)
 
 	BuildTiers(tiers)
 
+	tick := time.NewTicker(config.Interval()).C
 	for {
-		packet := <-filtered
-		for _, tier := range *tiers {
-			// FIXME(lindsay): fire off a goroutine for dispatch to each tier
-
-			// Get the target we should forward the packet to
-			target, err := tier.Lookup(packet.Hostname)
-			if err != nil {
-				log.Fatalf("[fatal] Send: couldn't lookup target: %s\n", err)
-			}
-
-			// Update metadata
-			name := MetricName(packet)
-			if tier.Mappings[target][packet.Hostname] == nil {
-				tier.Mappings[target][packet.Hostname] = make(map[string]int64)
+		select {
+		case packet := <-filtered:
+			for _, tier := range *tiers {
+				// FIXME(lindsay): fire off a goroutine for dispatch to each tier
+				tier.Dispatch(Frame{Packet: packet})
 			}
-			tier.Mappings[target][packet.Hostname][name] = time.Now().Unix()
-
-			// Dispatch the metric
-			payload := Encode(packet)
-			conn := tier.Connections[target]
-			if conn != nil {
-				_, err = tier.Connections[target].Write(payload)
-				if err != nil {
-					// Increment counter, but don't log because that will fill
-					// up the disk when a storage target goes away during a
-					// network partition.
-					errorCounts.Add("send.write", 1)
-					continue
-				}
-				// Update counters
-				hostCounts.Get(target).(*expvar.Int).Set(int64(len(tier.Mappings[target])))
-				mc := 0
-				for _, v := range tier.Mappings[target] {
-					mc += len(v)
+		case n := <-notifications:
+			notify(config, tiers, n)
+		case <-tick:
+			for _, tier := range *tiers {
+				for target := range tier.Buffers {
+					tier.Flush(target)
 				}
-				metricCounts.Get(target).(*expvar.Int).Set(int64(mc))
-				sendCounts.Add(target, 1)
-				sendCounts.Add("total", 1)
-			} else {
-				errorCounts.Add("send.disconnected", 1)
 			}
 		}
 	}
 }
 
+// Dispatch buffers a sample for the target that owns the sample's host,
+// dispatching the target's buffer if it's full. Samples the tier doesn't store
+// are skipped.
+func (t *Tier) Dispatch(frame Frame) {
+	packet := frame.Packet
+	name := MetricName(packet)
+	if !t.Stores(name) {
+		excludedCounts.Add(t.Name, 1)
+		return
+	}
+
+	// Get the target we should forward the packet to
+	target, err := t.Lookup(packet.Hostname)
+	if err != nil {
+		log.Fatalf("[fatal] Send: couldn't lookup target: %s\n", err)
+	}
+
+	// Reject new series from hosts that have too many
+	if _, ok := t.Mappings[target][packet.Hostname][name]; !ok && !t.admit(target, packet) {
+		return
+	}
+
+	// Update metadata
+	if t.Mappings[target][packet.Hostname] == nil {
+		t.Mappings[target][packet.Hostname] = make(map[string]int64)
+	}
+	t.Mappings[target][packet.Hostname][name] = time.Now().Unix()
+
+	if t.Connections[target] == nil {
+		errorCounts.Add("send.disconnected", 1)
+		return
+	}
+
+	// Buffer the metric, dispatching the buffer if it's full
+	buffer := t.Buffers[target]
+	err = buffer.AppendFrame(frame)
+	if err == ErrBufferFull {
+		t.Flush(target)
+		err = buffer.AppendFrame(frame)
+	}
+	switch err {
+	case nil:
+	case ErrBufferFull:
+		errorCounts.Add("send.oversize", 1)
+		return
+	default:
+		errorCounts.Add("send.encode", 1)
+		return
+	}
+
+	// Update counters
+	hostCounts.Get(target).(*expvar.Int).Set(int64(len(t.Mappings[target])))
+	mc := 0
+	for _, v := range t.Mappings[target] {
+		mc += len(v)
+	}
+	metricCounts.Get(target).(*expvar.Int).Set(int64(mc))
+}
+
+// Flush dispatches the samples buffered for a target.
+func (t *Tier) Flush(target string) {
+	buffer := t.Buffers[target]
+	if buffer.Len() == 0 {
+		return
+	}
+	samples := buffer.Samples()
+	payload, err := t.Seal(buffer.Bytes())
+	if err != nil {
+		errorCounts.Add("send.seal", 1)
+		buffer.Reset()
+		return
+	}
+	_, err = t.Connections[target].Write(payload)
+	buffer.Reset()
+	if err != nil {
+		// Increment counter, but don't log because that will fill
+		// up the disk when a storage target goes away during a
+		// network partition.
+		errorCounts.Add("send.write", 1)
+		return
+	}
+
+	// Update counters
+	sendCounts.Add(target, int64(samples))
+	sendCounts.Add("total", int64(samples))
+	flushCounts.Add("total", 1)
+	flushCounts.Add("bytes", int64(len(payload)))
+	flushCounts.Add("samples", int64(samples))
+	bytesPerFlush := new(expvar.Int)
+	bytesPerFlush.Set(int64(len(payload)))
+	flushCounts.Set("bytes_per_flush", bytesPerFlush)
+	samplesPerFlush := new(expvar.Int)
+	samplesPerFlush.Set(int64(samples))
+	flushCounts.Set("samples_per_flush", samplesPerFlush)
+}
+
 // Encode a Packet into the collectd wire protocol format.
-func Encode(packet collectd.Packet) []byte {
-	// String parts have a length of 5, because there is a terminating null byte
-	// Numeric parts have a length of 4, because there is no terminating null byte
+func Encode(packet collectd.Packet) ([]byte, error) {
+	return encode(collectd.Packet{}, packet)
+}
+
+// encode a Packet, omitting any parts that are unchanged from the last Packet
+// encoded into the same collectd packet.
+func encode(last collectd.Packet, packet collectd.Packet) ([]byte, error) {
+	buf, err := encodeMetadata(last, packet)
+	if err != nil {
+		return nil, err
+	}
+	return appendValues(buf, packet.Values)
+}
+
+/*
+encodeMetadata encodes every part of a Packet except its values, omitting
+the host, plugin, and type parts that are unchanged from the last Packet.
 
+Each Packet gets exactly one time part and one interval part, in whichever
+resolution it uses, so a receiver never mixes them up with the last Packet's.
+*/
+func encodeMetadata(last collectd.Packet, packet collectd.Packet) ([]byte, error) {
 	buf := make([]byte, 0)
-	null := []byte("\x00")
+	var err error
 
-	// Hostname - String part
-	hostBytes := []byte(packet.Hostname)
-	buf = append(buf, []byte{0, collectd.ParseHost}...)
-	buf = append(buf, []byte{0, byte(len(hostBytes) + 5)}...)
-	buf = append(buf, hostBytes...)
-	buf = append(buf, null...) // null bytes for string parts
+	if packet.Hostname != last.Hostname {
+		buf, err = appendString(buf, collectd.ParseHost, packet.Hostname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if packet.TimeHR > 0 {
+		buf = appendNumber(buf, collectd.ParseTimeHR, packet.TimeHR)
+	} else {
+		buf = appendNumber(buf, collectd.ParseTime, packet.Time)
+	}
+	if packet.IntervalHR > 0 {
+		buf = appendNumber(buf, collectd.ParseIntervalHR, packet.IntervalHR)
+	} else {
+		buf = appendNumber(buf, collectd.ParseInterval, packet.Interval)
+	}
+	if packet.Plugin != last.Plugin {
+		buf, err = appendString(buf, collectd.ParsePlugin, packet.Plugin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if packet.PluginInstance != last.PluginInstance {
+		buf, err = appendString(buf, collectd.ParsePluginInstance, packet.PluginInstance)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if packet.Type != last.Type {
+		buf, err = appendString(buf, collectd.ParseType, packet.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if packet.TypeInstance != last.TypeInstance {
+		buf, err = appendString(buf, collectd.ParseTypeInstance, packet.TypeInstance)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
 
-	// Time - Number part
-	if packet.Time > 0 {
-		timeBytes := new(bytes.Buffer)
-		binary.Write(timeBytes, binary.BigEndian, packet.Time)
-		buf = append(buf, []byte{0, collectd.ParseTime}...)
-		buf = append(buf, []byte{0, byte(len(timeBytes.Bytes()) + 4)}...)
-		buf = append(buf, timeBytes.Bytes()...)
+// ErrPartTooLarge is returned when a part won't fit in the 16 bit length
+// field of a part header.
+var ErrPartTooLarge = errors.New("part is too large to encode")
+
+// appendHeader appends a part header to buf.
+func appendHeader(buf []byte, kind uint16, length int) ([]byte, error) {
+	if length > math.MaxUint16 {
+		return nil, ErrPartTooLarge
 	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header[0:2], kind)
+	binary.BigEndian.PutUint16(header[2:4], uint16(length))
+	return append(buf, header...), nil
+}
 
-	// TimeHR - Number part
-	if packet.TimeHR > 0 {
-		timeHRBytes := new(bytes.Buffer)
-		binary.Write(timeHRBytes, binary.BigEndian, packet.TimeHR)
-		buf = append(buf, []byte{0, collectd.ParseTimeHR}...)
-		buf = append(buf, []byte{0, byte(len(timeHRBytes.Bytes()) + 4)}...)
-		buf = append(buf, timeHRBytes.Bytes()...)
+// appendString appends a string part to buf.
+func appendString(buf []byte, kind uint16, s string) ([]byte, error) {
+	// String parts have a length of 5, because there is a terminating null byte
+	buf, err := appendHeader(buf, kind, len(s)+5)
+	if err != nil {
+		return nil, err
 	}
+	buf = append(buf, []byte(s)...)
+	buf = append(buf, 0) // null bytes for string parts
+	return buf, nil
+}
+
+// appendNumber appends a numeric part to buf.
+func appendNumber(buf []byte, kind uint16, n uint64) []byte {
+	// Numeric parts have a length of 12, because the number is 8 bytes
+	buf, _ = appendHeader(buf, kind, 12)
+	number := make([]byte, 8)
+	binary.BigEndian.PutUint64(number, n)
+	return append(buf, number...)
+}
 
-	// Interval - Number part
-	if packet.Interval > 0 {
-		intervalBytes := new(bytes.Buffer)
-		binary.Write(intervalBytes, binary.BigEndian, packet.Interval)
-		buf = append(buf, []byte{0, collectd.ParseInterval}...)
-		buf = append(buf, []byte{0, byte(len(intervalBytes.Bytes()) + 4)}...)
-		buf = append(buf, intervalBytes.Bytes()...)
+// appendValues appends a values part to buf.
+func appendValues(buf []byte, values []collectd.Value) ([]byte, error) {
+	// type(2) + length(2) + number of values(2) == 6, then a byte for the
+	// type and 8 bytes for the value of each value
+	buf, err := appendHeader(buf, collectd.ParseValues, 6+len(values)*9)
+	if err != nil {
+		return nil, err
 	}
 
-	if packet.IntervalHR > 0 {
-		intervalHRBytes := new(bytes.Buffer)
-		binary.Write(intervalHRBytes, binary.BigEndian, packet.IntervalHR)
-		buf = append(buf, []byte{0, collectd.ParseIntervalHR}...)
-		buf = append(buf, []byte{0, byte(len(intervalHRBytes.Bytes()) + 4)}...)
-		buf = append(buf, intervalHRBytes.Bytes()...)
-	}
-
-	// Plugin - String part
-	pluginBytes := []byte(packet.Plugin)
-	buf = append(buf, []byte{0, collectd.ParsePlugin}...)
-	buf = append(buf, []byte{0, byte(len(pluginBytes) + 5)}...)
-	buf = append(buf, pluginBytes...)
-	buf = append(buf, null...) // null bytes for string parts
-
-	// PluginInstance - String part
-	if len(packet.PluginInstance) > 0 {
-		pluginInstanceBytes := []byte(packet.PluginInstance)
-		buf = append(buf, []byte{0, collectd.ParsePluginInstance}...)
-		buf = append(buf, []byte{0, byte(len(pluginInstanceBytes) + 5)}...)
-		buf = append(buf, pluginInstanceBytes...)
-		buf = append(buf, null...) // null bytes for string parts
-	}
-
-	// Type - String part
-	typeBytes := []byte(packet.Type)
-	buf = append(buf, []byte{0, collectd.ParseType}...)
-	buf = append(buf, []byte{0, byte(len(typeBytes) + 5)}...)
-	buf = append(buf, typeBytes...)
-	buf = append(buf, null...) // null bytes for string parts
-
-	// TypeInstance - String part
-	if len(packet.TypeInstance) > 0 {
-		typeInstanceBytes := []byte(packet.TypeInstance)
-		buf = append(buf, []byte{0, collectd.ParseTypeInstance}...)
-		buf = append(buf, []byte{0, byte(len(typeInstanceBytes) + 5)}...)
-		buf = append(buf, typeInstanceBytes...)
-		buf = append(buf, null...) // null bytes for string parts
-	}
-
-	// Values - Values part
-	valuesBuf := make([]byte, 0)
+	// Number of values
+	count := make([]byte, 2)
+	binary.BigEndian.PutUint16(count, uint16(len(values)))
+	buf = append(buf, count...)
 
 	// Write out the types
-	for _, v := range packet.Values {
-		valueTypeBytes := new(bytes.Buffer)
-		binary.Write(valueTypeBytes, binary.BigEndian, v.Type)
-		valuesBuf = append(valuesBuf, valueTypeBytes.Bytes()...)
+	for _, v := range values {
+		buf = append(buf, v.Type)
 	}
 
 	// Then write out the values
-	for _, v := range packet.Values {
-		valueBytes := new(bytes.Buffer)
-
+	for _, v := range values {
+		value := make([]byte, 8)
 		switch v.Type {
 		case collectd.TypeAbsolute:
-			absolute := uint64(v.Value)
-			binary.Write(valueBytes, binary.BigEndian, absolute)
+			binary.BigEndian.PutUint64(value, uint64(v.Value))
 		case collectd.TypeCounter:
-			counter := uint64(v.Value)
-			binary.Write(valueBytes, binary.BigEndian, counter)
+			binary.BigEndian.PutUint64(value, uint64(v.Value))
 		case collectd.TypeDerive:
-			derive := int64(v.Value)
-			binary.Write(valueBytes, binary.BigEndian, derive)
+			binary.BigEndian.PutUint64(value, uint64(int64(v.Value)))
 		case collectd.TypeGauge:
-			gauge := float64(v.Value)
-			binary.Write(valueBytes, binary.LittleEndian, gauge)
+			binary.LittleEndian.PutUint64(value, math.Float64bits(v.Value))
 		default:
-			binary.Write(valueBytes, binary.BigEndian, v.Value)
+			binary.BigEndian.PutUint64(value, math.Float64bits(v.Value))
 		}
-		valuesBuf = append(valuesBuf, valueBytes.Bytes()...)
+		buf = append(buf, value...)
 	}
 
-	// type(2) + length(2) + number of values(2) == 6
-	buf = append(buf, []byte{0, collectd.ParseValues}...)     // type
-	buf = append(buf, []byte{0, byte(len(valuesBuf) + 6)}...) // length
-	buf = append(buf, []byte{0, byte(len(packet.Values))}...) // number of values
-	buf = append(buf, valuesBuf...)                           // values themselves
-
-	return buf
+	return buf, nil
 }
 
-func TierLookup(params martini.Params, req *http.Request, tiers *[]Tier) []byte {
+func TierLookup(params martini.Params, req *http.Request, tiers *[]Tier, normaliser *Normaliser) []byte {
 	// Initialise the error counts
 	errorCounts.Add("lookup.hash.get", 0)
 
 	qs := req.URL.Query()
+	if len(qs["name"]) > 0 && len(qs["metric"]) > 0 {
+		return tierLookupMetric(normaliser.Hostname(qs["name"][0]), qs["metric"][0], tiers)
+	}
 	if len(qs["name"]) > 0 {
-		name := qs["name"][0]
+		name := normaliser.Hostname(qs["name"][0])
 		result := map[string]string{}
 
 		for _, tier := range *tiers {
@@ -462,6 +690,28 @@ func TierLookup(params martini.Params, req *http.Request, tiers *[]Tier) []byte
 	}
 }
 
+// TierRoute is where a tier would store a host's metric, if it stores it.
+type TierRoute struct {
+	Target string `json:"target"`
+	Stored bool   `json:"stored"`
+}
+
+// tierLookupMetric finds where each tier stores a host's metric.
+func tierLookupMetric(name string, metric string, tiers *[]Tier) []byte {
+	result := map[string]TierRoute{}
+	for _, tier := range *tiers {
+		target, err := tier.Lookup(name)
+		if err != nil {
+			log.Printf("[error] TierLookup: %s: %+v\n", name, err)
+			errorCounts.Add("lookup.hash.get", 1)
+		}
+		lookupCounts.Add(tier.Name, 1)
+		result[tier.Name] = TierRoute{Target: target, Stored: tier.Stores(metric)}
+	}
+	data, _ := json.Marshal(result)
+	return data
+}
+
 func ExpvarHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	fmt.Fprintf(w, "{")
@@ -502,11 +752,51 @@ func ExpvarHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "}\n")
 }
 
-func Api(config ApiConfig, tiers *[]Tier, blacklisted *map[string]map[string]int64) {
+// Api serves up the running state of Coco, and accepts samples posted by
+// collectd's write_http plugin, which are queued on raw. Filter rules can be
+// managed through the Api, if rules are given and a token is configured.
+func Api(config Config, rules *RuleSet, skews *SkewTracker, types *TypesDB, tiers *[]Tier, blacklisted *Blacklisted, raw chan collectd.Packet) {
+	// Initialise the error counts
+	errorCounts.Add("listen.http.receive", 0)
+	errorCounts.Add("listen.http.parse", 0)
+	errorCounts.Add("listen.http.full", 0)
+	errorCounts.Add("api.unauthorized", 0)
+	errorCounts.Add("filter.rules.save", 0)
+
+	// types.db is used to decode PUTVAL commands, and is shared with Listen
+	if types == nil && len(config.Listen.typesdbs()) > 0 {
+		var err error
+		types, err = WatchTypesDB(config.Listen)
+		if err != nil {
+			log.Fatalln("[fatal] API: failed to parse types.db", err)
+		}
+	}
+	// Rules are only managed by the Api when they're shared with Filter
+	manage := rules != nil
+	if rules == nil {
+		var err error
+		rules, err = NewRuleSet(config.Filter)
+		if err != nil {
+			log.Fatalln("[fatal] API:", err)
+		}
+	}
+	// Without Clock running, there are no skewed hosts to report
+	if skews == nil {
+		skews = NewSkewTracker()
+	}
+	normaliser, err := NewNormaliser(config.Normalise)
+	if err != nil {
+		log.Fatalln("[fatal] API:", err)
+	}
+	relabeller, err := NewRelabeller(config.Relabel)
+	if err != nil {
+		log.Fatalln("[fatal] API:", err)
+	}
+
 	m := martini.Classic()
 	// Endpoint for looking up what storage nodes own metrics for a host
 	m.Get("/lookup", func(params martini.Params, req *http.Request) []byte {
-		return TierLookup(params, req, tiers)
+		return TierLookup(params, req, tiers, normaliser)
 	})
 	// Dump out the list of targets Coco is hashing metrics to
 	m.Group("/tiers", func(r martini.Router) {
@@ -515,43 +805,330 @@ func Api(config ApiConfig, tiers *[]Tier, blacklisted *map[string]map[string]int
 			return data
 		})
 	})
+	// Dump out the metrics dropped by Filter, and when they were last seen
 	m.Get("/blacklisted", func(params martini.Params, req *http.Request) []byte {
-		data, _ := json.Marshal(*blacklisted)
+		qs := req.URL.Query()
+		data, _ := json.Marshal(blacklisted.LastSeen(qs.Get("host"), qs.Get("plugin")))
+		return data
+	})
+	// Dump out the metrics dropped by Filter, with their rules and hits
+	m.Get("/blacklisted/entries", func(params martini.Params, req *http.Request) []byte {
+		qs := req.URL.Query()
+		data, _ := json.Marshal(blacklisted.Entries(qs.Get("host"), qs.Get("plugin")))
+		return data
+	})
+	// Dump out the totals of the metrics dropped by Filter
+	m.Get("/blacklisted/summary", func(params martini.Params, req *http.Request) []byte {
+		qs := req.URL.Query()
+		data, _ := json.Marshal(blacklisted.Summary(qs.Get("host"), qs.Get("plugin")))
+		return data
+	})
+	// Dump out the TCP connections Listen is receiving packets on
+	m.Get("/listen/connections", func() []byte {
+		data, _ := json.Marshal(Connections())
+		return data
+	})
+	// Dump out the most recent packets that couldn't be decoded
+	m.Get("/debug/malformed", func() []byte {
+		data, _ := json.Marshal(RecentMalformed())
+		return data
+	})
+	// Dump out the most recently received notifications
+	m.Get("/notifications", func() []byte {
+		data, _ := json.Marshal(RecentNotifications())
+		return data
+	})
+	// Dump out the hosts that have had new series rejected
+	m.Get("/limits", func() []byte {
+		data, _ := json.Marshal(Limited())
+		return data
+	})
+	// Dump out the hosts with the worst clock skew, up to ?limit of them
+	m.Get("/clock-skew", func(req *http.Request) []byte {
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil {
+			limit = 20
+		}
+		data, _ := json.Marshal(skews.Worst(limit))
 		return data
 	})
+	// Dump out the types received that aren't in types.db
+	m.Get("/types/unknown", func() []byte {
+		data, _ := json.Marshal(UnknownTypes())
+		return data
+	})
+	// Accept samples from collectd's write_http plugin
+	m.Post("/collectd", func(w http.ResponseWriter, req *http.Request) {
+		var t collectd.Types
+		if types != nil {
+			t = types.Types()
+		}
+		WriteHTTP(w, req, t, rules.Rules(), raw)
+	})
+	// Show how a sample would be relabelled
+	m.Get("/relabel", func(w http.ResponseWriter, req *http.Request) {
+		RelabelDryRun(w, req, relabeller)
+	})
+	// Manage the filter rules
+	m.Group("/filter/rules", func(r martini.Router) {
+		r.Get("", func(w http.ResponseWriter) {
+			ListRules(w, rules)
+		})
+		r.Post("", func(w http.ResponseWriter, req *http.Request) {
+			AddRule(w, req, rules)
+		})
+		r.Post("/test", func(w http.ResponseWriter, req *http.Request) {
+			CheckRules(w, req, rules)
+		})
+		r.Delete("/:name", func(w http.ResponseWriter, params martini.Params) {
+			RemoveRule(w, rules, params["name"])
+		})
+	}, func(w http.ResponseWriter, req *http.Request) {
+		authorize(w, req, config.Api.Token, manage)
+	})
 	// Implement expvars.expvarHandler in Martini.
 	m.Get("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
 		ExpvarHandler(w, r)
 	})
 
-	log.Printf("[info] API: binding web server to %s", config.Bind)
-	log.Fatalf("[fatal] API: HTTP handler crashed: %s", http.ListenAndServe(config.Bind, m))
+	log.Printf("[info] API: binding web server to %s", config.Api.Bind)
+	log.Fatalf("[fatal] API: HTTP handler crashed: %s", http.ListenAndServe(config.Api.Bind, m))
 }
 
 type Config struct {
-	Listen  ListenConfig
-	Filter  FilterConfig
-	Tiers   map[string]TierConfig
-	Api     ApiConfig
-	Fetch   FetchConfig
-	Measure MeasureConfig
+	Listen    ListenConfig
+	Normalise NormaliseConfig
+	Relabel   RelabelConfig
+	Filter    FilterConfig
+	Limits    LimitsConfig
+	Clock     ClockConfig
+	Dedup     DedupConfig
+	Tiers     map[string]TierConfig
+	Send      SendConfig
+	Api       ApiConfig
+	Fetch     FetchConfig
+	Measure   MeasureConfig
 }
 
 type ListenConfig struct {
 	Bind    string
 	Typesdb string
+	// More types.db files, for custom types. Later files take precedence.
+	TypesdbFiles  []string `toml:"typesdb_files"`
+	Passthrough   bool
+	SecurityLevel string `toml:"security_level"`
+	// map[username]key, used to verify signed and decrypt encrypted packets
+	Users map[string]string
+	// Number of goroutines receiving packets, each on its own socket
+	Readers int
+	// Size of each socket's receive buffer, in bytes
+	ReadBuffer int `toml:"read_buffer"`
+	// CIDRs packets are accepted or rejected from. Deny takes precedence.
+	Allow []string
+	Deny  []string
+	// map[hostname][]cidr, restricting where samples for a host can come from
+	HostCIDRs map[string][]string `toml:"host_cidrs"`
+	TCP       TCPConfig
+	Graphite  GraphiteConfig
+	StatsD    StatsDConfig
+	InfluxDB  InfluxDBConfig
+}
+
+// Helper function to list all the types.db files
+func (l *ListenConfig) typesdbs() []string {
+	var paths []string
+	if len(l.Typesdb) > 0 {
+		paths = append(paths, l.Typesdb)
+	}
+	return append(paths, l.TypesdbFiles...)
+}
+
+// Helper function to provide a default number of readers
+func (l *ListenConfig) readers() int {
+	if l.Readers < 1 {
+		return 1
+	}
+	return l.Readers
+}
+
+type TCPConfig struct {
+	Bind string
+	// Serve TLS with this certificate and key
+	Cert string
+	Key  string
+	// Require clients to present a certificate signed by this CA
+	ClientCA string `toml:"client_ca"`
+	// Close connections that haven't sent a packet for this long
+	IdleTimeout Duration `toml:"idle_timeout"`
+}
+
+// Helper function to provide a default idle timeout
+func (t *TCPConfig) idleTimeout() time.Duration {
+	if t.IdleTimeout.Duration <= 0 {
+		return 5 * time.Minute
+	} else {
+		return t.IdleTimeout.Duration
+	}
+}
+
+type GraphiteConfig struct {
+	// Address to receive Graphite plaintext lines on, over TCP and UDP
+	Bind string
+	// Templates that map Graphite paths to samples, tried in order
+	Templates []string
+}
+
+type StatsDConfig struct {
+	Bind          string
+	FlushInterval Duration `toml:"flush_interval"`
+	// Host to send samples as, defaulting to the hostname Coco is running on
+	Host string
+	// Tag that overrides Host, if a metric is tagged with it
+	HostTag     string `toml:"host_tag"`
+	Percentiles []float64
+	// Flushes a counter or gauge can go without an update before it's forgotten
+	IdleFlushes int `toml:"idle_flushes"`
+}
+
+// Helper function to provide a default flush interval value
+func (s *StatsDConfig) Interval() time.Duration {
+	if s.FlushInterval.Duration == 0 {
+		return 10 * time.Second
+	} else {
+		return s.FlushInterval.Duration
+	}
+}
+
+// Helper function to provide a default number of idle flushes
+func (s *StatsDConfig) idleFlushes() int {
+	if s.IdleFlushes <= 0 {
+		return 60
+	} else {
+		return s.IdleFlushes
+	}
+}
+
+// Helper function to provide default timer percentiles
+func (s *StatsDConfig) percentiles() []float64 {
+	if s.Percentiles == nil {
+		return []float64{90}
+	}
+	return s.Percentiles
+}
+
+type InfluxDBConfig struct {
+	// Address to receive line protocol on, over HTTP and UDP
+	Bind string
+	// Tag that holds the host each sample is for
+	HostTag string `toml:"host_tag"`
+}
+
+// Helper function to provide a default host tag
+func (i *InfluxDBConfig) hostTag() string {
+	if len(i.HostTag) == 0 {
+		return "host"
+	}
+	return i.HostTag
+}
+
+type NormaliseConfig struct {
+	Lowercase bool
+	// Trim the trailing dot off fully qualified hostnames
+	TrimDot bool `toml:"trim_dot"`
+	// Domains to strip, the first that matches is stripped
+	StripDomain []string `toml:"strip_domain"`
+	// Domain to append to hostnames without one
+	AppendDomain string `toml:"append_domain"`
+	Rewrite      []RewriteConfig
+}
+
+type RewriteConfig struct {
+	Pattern     string
+	Replacement string
+}
+
+type RelabelConfig struct {
+	Rules []RelabelRuleConfig `toml:"rule"`
+}
+
+type RelabelRuleConfig struct {
+	Name string
+	// One of host, plugin, plugin_instance, type, type_instance, or data_source
+	Field       string
+	Pattern     string
+	Replacement string
+	// Only relabel samples whose host/metric name matches this regex
+	Metric string
 }
 
 type FilterConfig struct {
+	// Deprecated in favour of rules, and checked after them
 	Blacklist string
+	Rules     []RuleConfig `toml:"rule"`
+	// Rules changed through the Api are saved here, and take precedence over
+	// the rules above when Coco starts
+	RulesFile string `toml:"rules_file"`
+	// How long metrics stay listed at /blacklisted after they're last dropped
+	BlacklistTTL Duration `toml:"blacklist_ttl"`
+}
+
+// Helper function to provide a default blacklist TTL
+func (f *FilterConfig) TTL() time.Duration {
+	if f.BlacklistTTL.Duration <= 0 {
+		return 24 * time.Hour
+	} else {
+		return f.BlacklistTTL.Duration
+	}
+}
+
+type RuleConfig struct {
+	Name string `toml:"name" json:"name"`
+	// Either "allow" or "deny"
+	Action string `toml:"action" json:"action"`
+	// Regexes matched against each field, which match anything if empty
+	Host           string `toml:"host" json:"host"`
+	Plugin         string `toml:"plugin" json:"plugin"`
+	PluginInstance string `toml:"plugin_instance" json:"plugin_instance"`
+	Type           string `toml:"type" json:"type"`
+	TypeInstance   string `toml:"type_instance" json:"type_instance"`
 }
 
 type TierConfig struct {
-	Targets []string
+	Targets       []string
+	SecurityLevel string `toml:"security_level"`
+	Username      string
+	Password      string
+	// Regexes matched against metric names, deciding what the tier stores
+	Include []string
+	Exclude []string
+}
+
+type LimitsConfig struct {
+	// Maximum number of unique metric names per host, or unlimited if 0
+	MaxSeriesPerHost int `toml:"max_series_per_host" json:"max_series_per_host"`
+	// Maximum number of unique metric names per host's plugin, or unlimited if 0
+	MaxSeriesPerPlugin int `toml:"max_series_per_plugin" json:"max_series_per_plugin"`
+}
+
+type SendConfig struct {
+	FlushInterval Duration `toml:"flush_interval"`
+	// URL to POST notifications to, as JSON
+	NotificationWebhook string `toml:"notification_webhook"`
+}
+
+// Helper function to provide a default flush interval value
+func (s *SendConfig) Interval() time.Duration {
+	if s.FlushInterval.Duration == 0 {
+		return 1 * time.Second
+	} else {
+		return s.FlushInterval.Duration
+	}
 }
 
 type ApiConfig struct {
 	Bind string
+	// Bearer token required to manage filter rules
+	Token string
 }
 
 type FetchConfig struct {
@@ -571,6 +1148,42 @@ func (f *FetchConfig) Timeout() time.Duration {
 	}
 }
 
+type ClockConfig struct {
+	// Samples older than this are out of the window, unless it's 0
+	MaxAge Duration `toml:"max_age"`
+	// Samples further ahead than this are out of the window, unless it's 0
+	MaxAhead Duration `toml:"max_ahead"`
+	// Stamp samples outside the window with the time they're received, rather
+	// than dropping them
+	Restamp bool
+}
+
+type DedupConfig struct {
+	Enabled bool
+	// How long samples are remembered for
+	Window Duration
+	// Most samples remembered at once
+	MaxEntries int `toml:"max_entries"`
+}
+
+// Helper function to provide a default dedup window
+func (d *DedupConfig) window() time.Duration {
+	if d.Window.Duration <= 0 {
+		return time.Minute
+	} else {
+		return d.Window.Duration
+	}
+}
+
+// Helper function to provide a default dedup cache size
+func (d *DedupConfig) maxEntries() int {
+	if d.MaxEntries <= 0 {
+		return 100000
+	} else {
+		return d.MaxEntries
+	}
+}
+
 type MeasureConfig struct {
 	TickInterval Duration `toml:"interval"`
 }
@@ -602,7 +1215,44 @@ type Tier struct {
 	// map[target]map[sample host]map[sample metric name]last dispatched
 	Mappings        map[string]map[string]map[string]int64 `json:"routes"`
 	Connections     map[string]net.Conn                    `json:"connections,nil"`
+	Buffers         map[string]*Buffer                     `json:"-"`
 	VirtualReplicas int                                    `json:"virtual_replicas"`
+	// How packets are secured when dispatched to targets
+	SecurityLevel string `json:"security_level"`
+	Username      string `json:"username"`
+	Password      string `json:"-"`
+	// Regexes matched against metric names, deciding what the tier stores
+	Include []string         `json:"include,omitempty"`
+	Exclude []string         `json:"exclude,omitempty"`
+	include []*regexp.Regexp `json:"-"`
+	exclude []*regexp.Regexp `json:"-"`
+	// Caps on the number of series each host can store in the tier
+	Limits LimitsConfig `json:"limits"`
+	// map[tier, host, plugin]number of series stored
+	pluginSeries map[seriesKey]int
+}
+
+// Stores checks if a tier stores a metric. If the tier has include rules,
+// the metric must match one of them, and it must not match any exclude rules.
+func (t *Tier) Stores(name string) bool {
+	if len(t.include) > 0 {
+		included := false
+		for _, re := range t.include {
+			if re.MatchString(name) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, re := range t.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	return true
 }
 
 // Lookup maps a name to a target in a tier's hash
@@ -646,16 +1296,30 @@ func (t *Tier) SetMagicVirtualReplicaNumber(i int) {
 type BlacklistItem struct {
 	Packet collectd.Packet
 	Time   int64
+	// The rule that dropped the sample
+	Rule string
 }
 
 var (
 	listenCounts = expvar.NewMap("coco.listen")
 	filterCounts = expvar.NewMap("coco.filter")
 	sendCounts   = expvar.NewMap("coco.send")
+	flushCounts  = expvar.NewMap("coco.flush")
 	metricCounts = expvar.NewMap("coco.hash.metrics")
 	hostCounts   = expvar.NewMap("coco.hash.hosts")
 	distCounts   = expvar.NewMap("coco.hash.metrics_per_host")
 	lookupCounts = expvar.NewMap("coco.lookup")
 	queueCounts  = expvar.NewMap("coco.queues")
 	errorCounts  = expvar.NewMap("coco.errors")
+
+	notificationCounts = expvar.NewMap("coco.notifications")
+	ruleCounts         = expvar.NewMap("coco.filter.rules")
+	excludedCounts     = expvar.NewMap("coco.tiers.excluded")
+	relabelCounts      = expvar.NewMap("coco.relabel")
+	clockCounts        = expvar.NewMap("coco.clock")
+	dedupCounts        = expvar.NewMap("coco.dedup")
+	dedupRatio         = new(expvar.Float)
+	limitCounts        = expvar.NewMap("coco.limits")
+	blacklistCounts    = expvar.NewMap("coco.blacklist")
+	normaliseCounts    = expvar.NewMap("coco.normalise")
 )
@@ -1,16 +1,45 @@
 package coco
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"fmt"
 	"github.com/bulletproofnetworks/coco/coco"
 	collectd "github.com/kimor79/gollectd"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/quick"
 	"time"
 )
 
@@ -58,7 +87,8 @@ func TestFilterBlacklistsSamples(t *testing.T) {
 	raw := make(chan collectd.Packet)
 	filtered := make(chan collectd.Packet)
 	blacklist := make(chan coco.BlacklistItem, 1000)
-	go coco.Filter(config, raw, filtered, blacklist)
+	rules, _ := coco.NewRuleSet(config)
+	go coco.Filter(rules, raw, filtered, blacklist)
 
 	count := 0
 	go func() {
@@ -159,14 +189,14 @@ func TestSendWhenMissingConnection(t *testing.T) {
 	apiConfig := coco.ApiConfig{
 		Bind: "127.0.0.1:26880",
 	}
-	blacklisted := map[string]map[string]int64{}
-	go coco.Api(apiConfig, &tiers, &blacklisted)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
 
 	poll(t, apiConfig.Bind)
 
 	// Launch Send so we can test dispatch behaviour
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(coco.SendConfig{}, &tiers, filtered, nil)
 
 	// Query the expvars
 	var actual float64
@@ -223,7 +253,7 @@ func TestSend(t *testing.T) {
 		Typesdb: "../types.db",
 	}
 	samples := make(chan collectd.Packet)
-	go coco.Listen(listenConfig, samples)
+	go coco.Listen(listenConfig, nil, nil, samples, nil)
 
 	var receive collectd.Packet
 	done := make(chan bool)
@@ -245,7 +275,7 @@ func TestSend(t *testing.T) {
 	t.Logf("tiers: %+v\n", tiers)
 
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(coco.SendConfig{}, &tiers, filtered, nil)
 
 	// Test dispatch
 	send := collectd.Packet{
@@ -275,7 +305,7 @@ func TestEncodeAbsolute(t *testing.T) {
 		Typesdb: "../types.db",
 	}
 	raw := make(chan collectd.Packet, 500)
-	go coco.Listen(listenConfig, raw)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
 
 	// Setup sender
 	tierConfig := make(map[string]coco.TierConfig)
@@ -287,8 +317,12 @@ func TestEncodeAbsolute(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
+	sendConfig := coco.SendConfig{
+		FlushInterval: *new(coco.Duration),
+	}
+	sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
 
 	// Dispatch a sample
 	value := collectd.Value{
@@ -338,7 +372,7 @@ func TestEncodeCounter(t *testing.T) {
 		Typesdb: "../types.db",
 	}
 	raw := make(chan collectd.Packet, 500)
-	go coco.Listen(listenConfig, raw)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
 
 	// Setup sender
 	tierConfig := make(map[string]coco.TierConfig)
@@ -350,8 +384,12 @@ func TestEncodeCounter(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
+	sendConfig := coco.SendConfig{
+		FlushInterval: *new(coco.Duration),
+	}
+	sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
 
 	// Dispatch a sample
 	value := collectd.Value{
@@ -403,7 +441,7 @@ func TestEncodeDerive(t *testing.T) {
 		Typesdb: "../types.db",
 	}
 	raw := make(chan collectd.Packet, 500)
-	go coco.Listen(listenConfig, raw)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
 
 	// Setup sender
 	tierConfig := make(map[string]coco.TierConfig)
@@ -415,8 +453,12 @@ func TestEncodeDerive(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
+	sendConfig := coco.SendConfig{
+		FlushInterval: *new(coco.Duration),
+	}
+	sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
 
 	// Dispatch a sample
 	value := collectd.Value{
@@ -466,7 +508,7 @@ func TestEncodeGauge(t *testing.T) {
 		Typesdb: "../types.db",
 	}
 	raw := make(chan collectd.Packet, 500)
-	go coco.Listen(listenConfig, raw)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
 
 	// Setup sender
 	tierConfig := make(map[string]coco.TierConfig)
@@ -478,8 +520,12 @@ func TestEncodeGauge(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
+	sendConfig := coco.SendConfig{
+		FlushInterval: *new(coco.Duration),
+	}
+	sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
 
 	// Dispatch a sample
 	value := collectd.Value{
@@ -529,7 +575,7 @@ func TestSendTiers(t *testing.T) {
 		Typesdb: "../types.db",
 	}
 	raw := make(chan collectd.Packet)
-	go coco.Listen(listenConfig, raw)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
 
 	count := 0
 	go func() {
@@ -551,8 +597,12 @@ func TestSendTiers(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
+	sendConfig := coco.SendConfig{
+		FlushInterval: *new(coco.Duration),
+	}
+	sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
 
 	// Test dispatch
 	send := collectd.Packet{
@@ -585,14 +635,14 @@ func TestVirtualReplicasMagic(t *testing.T) {
 
 	// Setup Send
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(coco.SendConfig{}, &tiers, filtered, nil)
 
 	// Setup Api
 	apiConfig := coco.ApiConfig{
 		Bind: "127.0.0.1:26840",
 	}
-	blacklisted := map[string]map[string]int64{}
-	go coco.Api(apiConfig, &tiers, &blacklisted)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
 	poll(t, apiConfig.Bind)
 
 	// Fetch exposed tiers
@@ -632,14 +682,14 @@ func TestTierLookup(t *testing.T) {
 	}
 
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(coco.SendConfig{}, &tiers, filtered, nil)
 
 	// Setup API
 	apiConfig := coco.ApiConfig{
 		Bind: "0.0.0.0:25999",
 	}
-	blacklisted := map[string]map[string]int64{}
-	go coco.Api(apiConfig, &tiers, &blacklisted)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
 
 	poll(t, apiConfig.Bind)
 
@@ -677,8 +727,8 @@ func TestExpvars(t *testing.T) {
 	apiConfig := coco.ApiConfig{
 		Bind: "127.0.0.1:26080",
 	}
-	blacklisted := map[string]map[string]int64{}
-	go coco.Api(apiConfig, &tiers, &blacklisted)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
 
 	poll(t, apiConfig.Bind)
 
@@ -710,8 +760,8 @@ func TestMeasureQueues(t *testing.T) {
 		Bind: "127.0.0.1:26081",
 	}
 	var tiers []coco.Tier
-	blacklisted := map[string]map[string]int64{}
-	go coco.Api(apiConfig, &tiers, &blacklisted)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
 
 	poll(t, apiConfig.Bind)
 
@@ -784,8 +834,8 @@ func TestMeasureDistributionSummaryStats(t *testing.T) {
 	apiConfig := coco.ApiConfig{
 		Bind: "127.0.0.1:26810",
 	}
-	blacklisted := map[string]map[string]int64{}
-	go coco.Api(apiConfig, &tiers, &blacklisted)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
 	poll(t, apiConfig.Bind)
 
 	// Setup Measure
@@ -798,7 +848,7 @@ func TestMeasureDistributionSummaryStats(t *testing.T) {
 
 	// Setup Send
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(coco.SendConfig{}, &tiers, filtered, nil)
 
 	// Push packets to Send
 	// 1000 hosts
@@ -871,7 +921,7 @@ func TestVariance(t *testing.T) {
 	}
 
 	filtered := make(chan collectd.Packet)
-	go coco.Send(&tiers, filtered)
+	go coco.Send(coco.SendConfig{}, &tiers, filtered, nil)
 
 	// Test dispatch
 	for i := 0; i < 100000; i++ {
@@ -922,18 +972,19 @@ func TestBlacklisted(t *testing.T) {
 	raw := make(chan collectd.Packet)
 	filtered := make(chan collectd.Packet)
 	items := make(chan coco.BlacklistItem, 1000000)
-	go coco.Filter(config, raw, filtered, items)
+	rules, _ := coco.NewRuleSet(config)
+	go coco.Filter(rules, raw, filtered, items)
 
 	// Setup blacklist
-	blacklisted := map[string]map[string]int64{}
-	go coco.Blacklist(items, &blacklisted)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Blacklist(config, items, blacklisted)
 
 	// Setup Api
 	apiConfig := coco.ApiConfig{
 		Bind: "127.0.0.1:26082",
 	}
 	var tiers []coco.Tier
-	go coco.Api(apiConfig, &tiers, &blacklisted)
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
 	poll(t, apiConfig.Bind)
 
 	// Push 10 metrics through that should be blacklisted
@@ -968,3 +1019,3262 @@ func TestBlacklisted(t *testing.T) {
 		t.Errorf("Expected %d blacklisted metrics, got %d", count, expected)
 	}
 }
+
+// sign wraps a collectd payload in a HMAC-SHA-256 signature part
+func sign(payload []byte, username string, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(username))
+	mac.Write(payload)
+
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf[0:2], collectd.ParseSignature)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(4+sha256.Size+len(username)))
+	buf = append(buf, mac.Sum(nil)...)
+	buf = append(buf, []byte(username)...)
+	return append(buf, payload...)
+}
+
+// encrypt wraps a collectd payload in an AES-256-OFB encryption part
+func encrypt(payload []byte, username string, password string) []byte {
+	key := sha256.Sum256([]byte(password))
+	block, _ := aes.NewCipher(key[:])
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(iv)
+
+	sum := sha1.Sum(payload)
+	plain := append(sum[:], payload...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(encrypted, plain)
+
+	buf := make([]byte, 6)
+	binary.BigEndian.PutUint16(buf[0:2], collectd.ParseEncryption)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(6+len(username)+len(iv)+len(encrypted)))
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(username)))
+	buf = append(buf, []byte(username)...)
+	buf = append(buf, iv...)
+	return append(buf, encrypted...)
+}
+
+func TestListenVerifiesSignedPackets(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:          "127.0.0.1:25964",
+		Typesdb:       "../types.db",
+		SecurityLevel: "Sign",
+		Users:         map[string]string{"alice": "secret"},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+
+	errors := expvar.Get("coco.errors").(*expvar.Map)
+	unsigned := errors.Get("listen.security.unsigned").(*expvar.Int).Value()
+	unknown := errors.Get("listen.security.unknown_user").(*expvar.Int).Value()
+	bad := errors.Get("listen.security.bad_signature").(*expvar.Int).Value()
+
+	// Dispatch unsigned, badly signed, and correctly signed samples
+	payload, err := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+	})
+	if err != nil {
+		t.Fatalf("Couldn't encode packet: %s", err)
+	}
+	conn.Write(payload)
+	conn.Write(sign(payload, "mallory", "secret"))
+	conn.Write(sign(payload, "alice", "guess"))
+	conn.Write(sign(payload, "alice", "secret"))
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 1 {
+		t.Fatalf("Expected %d packets, got %d\n", 1, len(raw))
+	}
+	if p := <-raw; p.Hostname != "foo" {
+		t.Errorf("Expected %s got %s", "foo", p.Hostname)
+	}
+
+	counts := map[string]int64{
+		"listen.security.unsigned":      unsigned,
+		"listen.security.unknown_user":  unknown,
+		"listen.security.bad_signature": bad,
+	}
+	for k, before := range counts {
+		after := errors.Get(k).(*expvar.Int).Value()
+		if after-before != 1 {
+			t.Errorf("Expected coco.errors.%s to increase by %d, increased by %d", k, 1, after-before)
+		}
+	}
+}
+
+func TestListenAcceptsUnverifiedPacketsWithoutSecurity(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25965",
+		Typesdb: "../types.db",
+		Users:   map[string]string{"alice": "secret"},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+
+	// Dispatch unsigned and badly signed samples
+	payload, err := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+	})
+	if err != nil {
+		t.Fatalf("Couldn't encode packet: %s", err)
+	}
+	conn.Write(payload)
+	conn.Write(sign(payload, "alice", "guess"))
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 2 {
+		t.Errorf("Expected %d packets, got %d\n", 2, len(raw))
+	}
+}
+
+func TestListenDecryptsEncryptedPackets(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:          "127.0.0.1:25966",
+		Typesdb:       "../types.db",
+		SecurityLevel: "Encrypt",
+		Users:         map[string]string{"alice": "secret"},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+
+	errors := expvar.Get("coco.errors").(*expvar.Map)
+	unencrypted := errors.Get("listen.security.unencrypted").(*expvar.Int).Value()
+	decrypt := errors.Get("listen.security.decrypt").(*expvar.Int).Value()
+
+	// Dispatch signed, badly encrypted, and correctly encrypted samples
+	value := collectd.Value{
+		Name:     "value",
+		Type:     uint8(1),
+		TypeName: "gauge",
+		Value:    0.5,
+	}
+	payload, err := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+		Values:   []collectd.Value{value},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't encode packet: %s", err)
+	}
+	conn.Write(sign(payload, "alice", "secret"))
+	conn.Write(encrypt(payload, "alice", "guess"))
+	conn.Write(encrypt(payload, "alice", "secret"))
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 1 {
+		t.Fatalf("Expected %d packets, got %d\n", 1, len(raw))
+	}
+	p := <-raw
+	if p.Hostname != "foo" {
+		t.Errorf("Expected %s got %s", "foo", p.Hostname)
+	}
+	if len(p.Values) != 1 || p.Values[0].Value != value.Value {
+		t.Errorf("Expected values %+v, got %+v", []collectd.Value{value}, p.Values)
+	}
+
+	if n := errors.Get("listen.security.unencrypted").(*expvar.Int).Value(); n-unencrypted != 1 {
+		t.Errorf("Expected coco.errors.listen.security.unencrypted to increase by %d, increased by %d", 1, n-unencrypted)
+	}
+	if n := errors.Get("listen.security.decrypt").(*expvar.Int).Value(); n-decrypt != 1 {
+		t.Errorf("Expected coco.errors.listen.security.decrypt to increase by %d, increased by %d", 1, n-decrypt)
+	}
+}
+
+func TestSendSecuresPackets(t *testing.T) {
+	for i, level := range []string{"sign", "encrypt"} {
+		// Setup listen
+		listenConfig := coco.ListenConfig{
+			Bind:          "127.0.0.1:" + strconv.Itoa(25967+i),
+			Typesdb:       "../types.db",
+			SecurityLevel: level,
+			Users:         map[string]string{"coco": "secret"},
+		}
+		raw := make(chan collectd.Packet, 500)
+		go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+		// Breathe a moment so the listener is bound
+		time.Sleep(100 * time.Millisecond)
+
+		// Setup sender
+		tiers := []coco.Tier{
+			coco.Tier{
+				Name:          "a",
+				Targets:       []string{listenConfig.Bind},
+				SecurityLevel: level,
+				Username:      "coco",
+				Password:      "secret",
+			},
+		}
+		sendConfig := coco.SendConfig{
+			FlushInterval: *new(coco.Duration),
+		}
+		sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
+		filtered := make(chan collectd.Packet)
+		go coco.Send(sendConfig, &tiers, filtered, nil)
+
+		filtered <- collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "load",
+			Type:     "load",
+		}
+
+		// Breathe a moment so packet works its way through
+		time.Sleep(100 * time.Millisecond)
+		if len(raw) != 1 {
+			t.Errorf("Expected %d packets when %s, got %d\n", 1, level, len(raw))
+		}
+	}
+}
+
+// counter returns the value of a counter in an expvar map, or 0 if it hasn't
+// been incremented yet
+func counter(name string, key string) int64 {
+	if v, ok := expvar.Get(name).(*expvar.Map).Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestBufferOmitsUnchangedParts(t *testing.T) {
+	types, err := collectd.TypesDBFile("../types.db")
+	if err != nil {
+		t.Fatalf("Couldn't parse types.db: %s", err)
+	}
+
+	// Buffer samples for the same host and plugin
+	buffer := coco.NewBuffer(coco.MaxPacketSize)
+	var samples []collectd.Packet
+	for _, name := range []string{"user", "system", "wait"} {
+		samples = append(samples, collectd.Packet{
+			Hostname:       "foo",
+			Plugin:         "cpu",
+			PluginInstance: "0",
+			Type:           "cpu",
+			TypeInstance:   name,
+			Interval:       10,
+			Time:           uint64(time.Now().Unix()),
+			Values:         []collectd.Value{{Name: "value", Type: collectd.TypeDerive, TypeName: "derive", Value: 5}},
+		})
+	}
+	size := 0
+	for _, sample := range samples {
+		if err := buffer.Append(sample); err != nil {
+			t.Fatalf("Couldn't append sample to buffer: %s", err)
+		}
+		payload, err := coco.Encode(sample)
+		if err != nil {
+			t.Fatalf("Couldn't encode packet: %s", err)
+		}
+		size += len(payload)
+	}
+
+	if buffer.Len() >= size {
+		t.Errorf("Expected buffer to be smaller than %d bytes, was %d", size, buffer.Len())
+	}
+
+	// Decode the buffer, and check the samples survived
+	packets, err := collectd.Packets(buffer.Bytes(), types)
+	if err != nil {
+		t.Fatalf("Couldn't decode buffer: %s", err)
+	}
+	if len(*packets) != len(samples) {
+		t.Fatalf("Expected %d samples, got %d", len(samples), len(*packets))
+	}
+	for i, p := range *packets {
+		if coco.MetricName(p) != coco.MetricName(samples[i]) || p.Hostname != samples[i].Hostname {
+			t.Errorf("Expected %s/%s got %s/%s", samples[i].Hostname, coco.MetricName(samples[i]), p.Hostname, coco.MetricName(p))
+		}
+	}
+}
+
+func TestBufferMixedResolutions(t *testing.T) {
+	// Samples alternating between high and low resolution times and intervals
+	samples := []collectd.Packet{
+		{Hostname: "foo", Plugin: "load", Type: "load", TimeHR: 1435639791 << 30, IntervalHR: 10 << 30},
+		{Hostname: "foo", Plugin: "load", Type: "load", Time: 1435639792, Interval: 10},
+		{Hostname: "foo", Plugin: "load", Type: "load", TimeHR: 1435639793 << 30, Interval: 10},
+		{Hostname: "foo", Plugin: "load", Type: "load", Time: 1435639794, IntervalHR: 10 << 30},
+	}
+	buffer := coco.NewBuffer(coco.MaxPacketSize)
+	for _, sample := range samples {
+		sample.Values = []collectd.Value{{Name: "value", Type: collectd.TypeGauge, TypeName: "gauge", Value: 1}}
+		if err := buffer.Append(sample); err != nil {
+			t.Fatalf("Couldn't append sample to buffer: %s", err)
+		}
+	}
+
+	// Test
+	// Collect the time and interval parts written before each values part
+	var parts [][]uint16
+	var numbers [][]uint64
+	var kinds []uint16
+	var values []uint64
+	buf := buffer.Bytes()
+	for len(buf) > 0 {
+		kind := binary.BigEndian.Uint16(buf[0:2])
+		length := int(binary.BigEndian.Uint16(buf[2:4]))
+		switch kind {
+		case collectd.ParseTime, collectd.ParseTimeHR, collectd.ParseInterval, collectd.ParseIntervalHR:
+			kinds = append(kinds, kind)
+			values = append(values, binary.BigEndian.Uint64(buf[4:length]))
+		case collectd.ParseValues:
+			parts = append(parts, kinds)
+			numbers = append(numbers, values)
+			kinds, values = nil, nil
+		}
+		buf = buf[length:]
+	}
+
+	if len(parts) != len(samples) {
+		t.Fatalf("Expected %d value lists, got %d", len(samples), len(parts))
+	}
+	for i, sample := range samples {
+		expected := []uint16{collectd.ParseTime, collectd.ParseInterval}
+		times := []uint64{sample.Time, sample.Interval}
+		if sample.TimeHR > 0 {
+			expected[0], times[0] = collectd.ParseTimeHR, sample.TimeHR
+		}
+		if sample.IntervalHR > 0 {
+			expected[1], times[1] = collectd.ParseIntervalHR, sample.IntervalHR
+		}
+		if !reflect.DeepEqual(parts[i], expected) {
+			t.Errorf("Expected sample %d to have parts %v, got %v", i, expected, parts[i])
+		}
+		if !reflect.DeepEqual(numbers[i], times) {
+			t.Errorf("Expected sample %d to have times and intervals %v, got %v", i, times, numbers[i])
+		}
+	}
+}
+
+func TestSendBatchesSamples(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25969",
+		Typesdb: "../types.db",
+	}
+	raw := make(chan collectd.Packet, 5000)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	// Setup sender
+	tiers := []coco.Tier{coco.Tier{Name: "a", Targets: []string{listenConfig.Bind}}}
+	sendConfig := coco.SendConfig{
+		FlushInterval: *new(coco.Duration),
+	}
+	sendConfig.FlushInterval.UnmarshalText([]byte("50ms"))
+	filtered := make(chan collectd.Packet)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
+
+	listened := counter("coco.listen", "raw")
+
+	// Dispatch a bunch of samples
+	count := 1000
+	for i := 0; i < count; i++ {
+		filtered <- collectd.Packet{
+			Hostname:     "foo",
+			Plugin:       "irq",
+			Type:         "irq",
+			TypeInstance: strconv.Itoa(i),
+			Values:       []collectd.Value{{Name: "value", Type: collectd.TypeDerive, TypeName: "derive", Value: float64(i)}},
+		}
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(200 * time.Millisecond)
+	if len(raw) != count {
+		t.Errorf("Expected %d samples, got %d\n", count, len(raw))
+	}
+
+	datagrams := counter("coco.listen", "raw") - listened
+	if datagrams >= int64(count)/10 {
+		t.Errorf("Expected samples to be batched into fewer than %d datagrams, got %d", count/10, datagrams)
+	}
+
+	flush := expvar.Get("coco.flush").(*expvar.Map)
+	for _, k := range []string{"bytes_per_flush", "samples_per_flush"} {
+		if flush.Get(k) == nil {
+			t.Errorf("Expected coco.flush.%s to be exposed", k)
+		}
+	}
+}
+
+// typedPacket is a Packet for a type in types.db, with values that match the
+// type's data sources
+type typedPacket struct {
+	collectd.Packet
+}
+
+var testTypes collectd.Types
+
+// randomString returns a string that can push a part past 255 bytes
+func randomString(r *rand.Rand) string {
+	b := make([]byte, r.Intn(600))
+	for i := range b {
+		b[i] = byte('!' + r.Intn('~'-'!'))
+	}
+	return string(b)
+}
+
+func (typedPacket) Generate(r *rand.Rand, size int) reflect.Value {
+	var names []string
+	for name := range testTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	name := names[r.Intn(len(names))]
+
+	packet := collectd.Packet{
+		Hostname:       randomString(r),
+		Plugin:         randomString(r),
+		PluginInstance: randomString(r),
+		Type:           name,
+		TypeInstance:   randomString(r),
+	}
+	// Samples are sent with times and intervals in one resolution or the other
+	if r.Intn(2) == 0 {
+		packet.Time = uint64(r.Int63())
+	} else {
+		packet.TimeHR = uint64(r.Int63())
+	}
+	if r.Intn(2) == 0 {
+		packet.Interval = uint64(r.Int63())
+	} else {
+		packet.IntervalHR = uint64(r.Int63())
+	}
+	for _, ds := range testTypes[name] {
+		value := collectd.Value{
+			Name:     ds.Name,
+			Type:     ds.Type,
+			TypeName: collectd.ValueTypeValues[ds.Type],
+		}
+		// Counters and derives are integers, so stay within what a float64
+		// can represent exactly
+		switch ds.Type {
+		case collectd.TypeGauge:
+			value.Value = r.NormFloat64() * 1e6
+		case collectd.TypeDerive:
+			value.Value = float64(r.Int63n(1<<53) - 1<<52)
+		default:
+			value.Value = float64(r.Int63n(1 << 53))
+		}
+		packet.Values = append(packet.Values, value)
+	}
+	return reflect.ValueOf(typedPacket{packet})
+}
+
+// roundTrip encodes a Packet, and decodes it again
+func roundTrip(packet collectd.Packet) (collectd.Packet, error) {
+	payload, err := coco.Encode(packet)
+	if err != nil {
+		return collectd.Packet{}, err
+	}
+	packets, err := collectd.Packets(payload, testTypes)
+	if err != nil {
+		return collectd.Packet{}, err
+	}
+	if len(*packets) != 1 {
+		return collectd.Packet{}, fmt.Errorf("expected %d packets, got %d", 1, len(*packets))
+	}
+	return (*packets)[0], nil
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	types, err := collectd.TypesDBFile("../types.db")
+	if err != nil {
+		t.Fatalf("Couldn't parse types.db: %s", err)
+	}
+	testTypes = types
+
+	f := func(p typedPacket) bool {
+		packet, err := roundTrip(p.Packet)
+		if err != nil {
+			t.Logf("Couldn't round trip %s: %s", p.Packet.Type, err)
+			return false
+		}
+		return reflect.DeepEqual(packet, p.Packet)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeRejectsOversizedParts(t *testing.T) {
+	packets := []collectd.Packet{
+		collectd.Packet{
+			Hostname: strings.Repeat("a", 65536),
+			Plugin:   "load",
+			Type:     "load",
+		},
+		collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "load",
+			Type:     "load",
+			Values:   make([]collectd.Value, 8000),
+		},
+	}
+	for _, packet := range packets {
+		if _, err := coco.Encode(packet); err != coco.ErrPartTooLarge {
+			t.Errorf("Expected %s, got %s", coco.ErrPartTooLarge, err)
+		}
+	}
+}
+
+func FuzzEncode(f *testing.F) {
+	types, err := collectd.TypesDBFile("../types.db")
+	if err != nil {
+		f.Fatalf("Couldn't parse types.db: %s", err)
+	}
+	testTypes = types
+
+	f.Add("foo", "load", "", "", uint64(1435639791), 0.5)
+	f.Add(strings.Repeat("a", 300), "cpu", "0", "idle", uint64(0), 1e9)
+	f.Add("foo", strings.Repeat("b", 70000), "", "", uint64(10), -1.0)
+	f.Fuzz(func(t *testing.T, host string, plugin string, pluginInstance string, typeInstance string, timestamp uint64, value float64) {
+		send := collectd.Packet{
+			Hostname:       host,
+			Plugin:         plugin,
+			PluginInstance: pluginInstance,
+			Type:           "gauge",
+			TypeInstance:   typeInstance,
+			Time:           timestamp,
+			Values: []collectd.Value{
+				{Name: "value", Type: collectd.TypeGauge, TypeName: "gauge", Value: value},
+			},
+		}
+		receive, err := roundTrip(send)
+		if err == coco.ErrPartTooLarge {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Couldn't round trip %+v: %s", send, err)
+		}
+
+		// Compare gauges bit for bit, so NaN matches NaN
+		if math.Float64bits(receive.Values[0].Value) != math.Float64bits(value) {
+			t.Errorf("Expected value %v, got %v", value, receive.Values[0].Value)
+		}
+		receive.Values, send.Values = nil, nil
+		if !reflect.DeepEqual(receive, send) {
+			t.Errorf("Expected %+v, got %+v", send, receive)
+		}
+	})
+}
+
+func TestSplit(t *testing.T) {
+	// Build a packet with a type that isn't in types.db, and a counter too
+	// big to survive being decoded into a float64
+	samples := []collectd.Packet{
+		collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "custom",
+			Type:     "not_in_types_db",
+			Time:     1435639791,
+			Values: []collectd.Value{
+				{Type: collectd.TypeGauge, Value: 0.5},
+				{Type: collectd.TypeGauge, Value: 1.5},
+			},
+		},
+		collectd.Packet{
+			Hostname:     "foo",
+			Plugin:       "irq",
+			Type:         "irq",
+			TypeInstance: "7",
+			Time:         1435639791,
+			Values:       []collectd.Value{{Type: collectd.TypeCounter, Value: 1}},
+		},
+	}
+	buffer := coco.NewBuffer(coco.MaxPacketSize)
+	for _, sample := range samples {
+		if err := buffer.Append(sample); err != nil {
+			t.Fatalf("Couldn't append sample to buffer: %s", err)
+		}
+	}
+	payload := buffer.Bytes()
+	// Overwrite the counter with a value that can't be represented as a float64
+	binary.BigEndian.PutUint64(payload[len(payload)-8:], 1<<60+1)
+
+	frames, err := coco.Split(payload)
+	if err != nil {
+		t.Fatalf("Couldn't split packet: %s", err)
+	}
+	if len(frames) != len(samples) {
+		t.Fatalf("Expected %d frames, got %d", len(samples), len(frames))
+	}
+	for i, frame := range frames {
+		if coco.MetricName(frame.Packet) != coco.MetricName(samples[i]) || frame.Packet.Hostname != samples[i].Hostname {
+			t.Errorf("Expected %s/%s got %s/%s", samples[i].Hostname, coco.MetricName(samples[i]), frame.Packet.Hostname, coco.MetricName(frame.Packet))
+		}
+		if frame.Packet.Time != samples[i].Time {
+			t.Errorf("Expected time %d, got %d", samples[i].Time, frame.Packet.Time)
+		}
+	}
+	if !bytes.HasSuffix(payload, frames[1].Values) {
+		t.Errorf("Expected values part to be sliced out of the packet unchanged")
+	}
+
+	// Truncated packets are invalid
+	if _, err := coco.Split(payload[:len(payload)-1]); err != collectd.ErrorInvalid {
+		t.Errorf("Expected %s, got %s", collectd.ErrorInvalid, err)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	// Setup a target that records the datagrams it receives
+	laddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:25971")
+	if err != nil {
+		t.Fatal("Couldn't resolve address", err)
+	}
+	target, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("Couldn't listen to %s: %s", laddr, err)
+	}
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			buf := make([]byte, coco.MaxPacketSize)
+			n, err := target.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- buf[0:n]
+		}
+	}()
+
+	// Setup passthrough
+	config := coco.Config{
+		Listen: coco.ListenConfig{Bind: "127.0.0.1:25970", Passthrough: true},
+		Filter: coco.FilterConfig{Blacklist: "/(vmem|irq|entropy|users)/"},
+	}
+	config.Send.FlushInterval.UnmarshalText([]byte("10ms"))
+	tiers := []coco.Tier{coco.Tier{Name: "a", Targets: []string{laddr.String()}}}
+	items := make(chan coco.BlacklistItem, 10)
+	rules, _ := coco.NewRuleSet(config.Filter)
+	go coco.Passthrough(config, rules, coco.NewSkewTracker(), &tiers, items)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("udp", config.Listen.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", config.Listen.Bind, err)
+	}
+
+	// Dispatch a sample that passes the filter, and one that doesn't
+	buffer := coco.NewBuffer(coco.MaxPacketSize)
+	buffer.Append(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "custom",
+		Type:     "not_in_types_db",
+		Values:   []collectd.Value{{Type: collectd.TypeCounter, Value: 1}},
+	})
+	buffer.Append(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "irq",
+		Type:     "irq",
+		Values:   []collectd.Value{{Type: collectd.TypeCounter, Value: 1}},
+	})
+	payload := buffer.Bytes()
+	frames, _ := coco.Split(payload)
+	// Overwrite the counter with a value that can't be represented as a float64
+	binary.BigEndian.PutUint64(frames[0].Values[len(frames[0].Values)-8:], 1<<60+1)
+	conn.Write(payload)
+
+	select {
+	case buf := <-received:
+		forwarded, err := coco.Split(buf)
+		if err != nil {
+			t.Fatalf("Couldn't split forwarded packet: %s", err)
+		}
+		if len(forwarded) != 1 {
+			t.Fatalf("Expected %d forwarded frames, got %d", 1, len(forwarded))
+		}
+		if !bytes.Equal(forwarded[0].Values, frames[0].Values) {
+			t.Errorf("Expected values part %x, got %x", frames[0].Values, forwarded[0].Values)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for forwarded packet")
+	}
+
+	if len(items) != 1 {
+		t.Errorf("Expected %d blacklisted samples, got %d", 1, len(items))
+	}
+}
+
+// frame prefixes a collectd payload with its length, for sending over TCP
+func frame(payload []byte) []byte {
+	buf := make([]byte, 2, 2+len(payload))
+	binary.BigEndian.PutUint16(buf, uint16(len(payload)))
+	return append(buf, payload...)
+}
+
+func TestListenTCP(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25972",
+		Typesdb: "../types.db",
+		TCP:     coco.TCPConfig{Bind: "127.0.0.1:25973"},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26083",
+	}
+	var tiers []coco.Tier
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	conn, err := net.Dial("tcp", listenConfig.TCP.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.TCP.Bind, err)
+	}
+	defer conn.Close()
+
+	// Dispatch two packets, split across writes
+	payload, err := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+	})
+	if err != nil {
+		t.Fatalf("Couldn't encode packet: %s", err)
+	}
+	stream := append(frame(payload), frame(payload)...)
+	conn.Write(stream[:3])
+	conn.Write(stream[3:])
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 2 {
+		t.Fatalf("Expected %d packets, got %d\n", 2, len(raw))
+	}
+	if p := <-raw; p.Hostname != "foo" {
+		t.Errorf("Expected %s got %s", "foo", p.Hostname)
+	}
+
+	// Fetch the connection stats
+	resp, err := http.Get("http://" + apiConfig.Bind + "/listen/connections")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	var result map[string]coco.Connection
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatalf("Error when decoding JSON %+v: %s", err, string(body))
+	}
+
+	stats, ok := result[conn.LocalAddr().String()]
+	if !ok {
+		t.Fatalf("Expected stats for %s, got %+v", conn.LocalAddr(), result)
+	}
+	if stats.Packets != 2 {
+		t.Errorf("Expected %d packets, got %d", 2, stats.Packets)
+	}
+	if stats.Bytes != int64(2*len(payload)) {
+		t.Errorf("Expected %d bytes, got %d", 2*len(payload), stats.Bytes)
+	}
+	if stats.TLS {
+		t.Errorf("Expected connection not to be TLS")
+	}
+}
+
+// writeCert generates a self signed certificate for 127.0.0.1 that can be
+// used by both servers and clients, and returns the paths to it and its key.
+func TestListenTCPClosesIdleConnections(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25998",
+		Typesdb: "../types.db",
+		TCP:     coco.TCPConfig{Bind: "127.0.0.1:25959"},
+	}
+	listenConfig.TCP.IdleTimeout.UnmarshalText([]byte("200ms"))
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+	poll(t, listenConfig.TCP.Bind)
+
+	conn, err := net.Dial("tcp", listenConfig.TCP.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.TCP.Bind, err)
+	}
+	defer conn.Close()
+
+	// Packets keep the connection open past the idle timeout
+	payload, err := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+	})
+	if err != nil {
+		t.Fatalf("Couldn't encode packet: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write(frame(payload)); err != nil {
+			t.Fatalf("Couldn't write packet: %s", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 3 {
+		t.Fatalf("Expected %d packets, got %d\n", 3, len(raw))
+	}
+
+	// Test the idle connection is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected idle connection to be closed, got %v", err)
+	}
+}
+
+func writeCert(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Couldn't create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Couldn't marshal key: %s", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestListenTLSVerifiesClients(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeCert(t, dir, "server")
+	clientCert, clientKey := writeCert(t, dir, "client")
+	strangerCert, strangerKey := writeCert(t, dir, "stranger")
+
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25974",
+		Typesdb: "../types.db",
+		TCP: coco.TCPConfig{
+			Bind:     "127.0.0.1:25975",
+			Cert:     serverCert,
+			Key:      serverKey,
+			ClientCA: clientCert,
+		},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	ca, _ := ioutil.ReadFile(serverCert)
+	roots.AppendCertsFromPEM(ca)
+
+	payload, err := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+	})
+	if err != nil {
+		t.Fatalf("Couldn't encode packet: %s", err)
+	}
+
+	// Dispatch a packet from a client that isn't trusted, then one that is
+	for _, c := range [][]string{{strangerCert, strangerKey}, {clientCert, clientKey}} {
+		cert, err := tls.LoadX509KeyPair(c[0], c[1])
+		if err != nil {
+			t.Fatalf("Couldn't load client certificate: %s", err)
+		}
+		conn, err := tls.Dial("tcp", listenConfig.TCP.Bind, &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{cert},
+		})
+		if err != nil {
+			continue
+		}
+		conn.Write(frame(payload))
+		defer conn.Close()
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 1 {
+		t.Fatalf("Expected %d packets, got %d\n", 1, len(raw))
+	}
+	if p := <-raw; p.Hostname != "foo" {
+		t.Errorf("Expected %s got %s", "foo", p.Hostname)
+	}
+
+	var clients []string
+	for _, stats := range coco.Connections() {
+		if stats.TLS {
+			clients = append(clients, stats.Client)
+		}
+	}
+	if len(clients) != 1 || clients[0] != "client" {
+		t.Errorf("Expected a single TLS connection from %s, got %+v", "client", clients)
+	}
+}
+
+func TestParseGraphite(t *testing.T) {
+	var templates []*coco.GraphiteTemplate
+	for _, spec := range []string{
+		"servers.*.cpu .host.plugin.plugin_instance.type_instance",
+		"apps .host.plugin.type_instance*",
+		"*.example host.host.plugin.type.type_instance",
+		coco.DefaultGraphiteTemplate,
+	} {
+		tmpl, err := coco.ParseGraphiteTemplate(spec)
+		if err != nil {
+			t.Fatalf("Couldn't parse template %s: %s", spec, err)
+		}
+		templates = append(templates, tmpl)
+	}
+
+	examples := map[string]collectd.Packet{
+		"servers.foo.cpu.0.idle 98.5 1435639791": collectd.Packet{
+			Hostname: "foo", Plugin: "cpu", PluginInstance: "0", Type: "gauge", TypeInstance: "idle",
+		},
+		"apps.bar.nginx.requests.2xx.get 12 1435639791": collectd.Packet{
+			Hostname: "bar", Plugin: "nginx", Type: "gauge", TypeInstance: "requests.2xx.get",
+		},
+		"baz.example.memory.memory.free 1024 1435639791": collectd.Packet{
+			Hostname: "baz.example", Plugin: "memory", Type: "memory", TypeInstance: "free",
+		},
+		"qux.load.0.load.shortterm 0.5 1435639791": collectd.Packet{
+			Hostname: "qux", Plugin: "load", PluginInstance: "0", Type: "load", TypeInstance: "shortterm",
+		},
+	}
+	for line, expected := range examples {
+		packet, err := coco.ParseGraphite(line, templates)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %s", line, err)
+			continue
+		}
+		if packet.Time != 1435639791 {
+			t.Errorf("Expected time %d, got %d", 1435639791, packet.Time)
+		}
+		if len(packet.Values) != 1 || packet.Values[0].Type != collectd.TypeGauge {
+			t.Errorf("Expected a single gauge value, got %+v", packet.Values)
+		}
+		expected.Time = packet.Time
+		expected.Values = packet.Values
+		if !reflect.DeepEqual(packet, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, packet)
+		}
+	}
+
+	errors := map[string]error{
+		"foo.cpu 1":                        coco.ErrGraphiteLine,
+		"foo.cpu.0.cpu.idle ninety 123":    coco.ErrGraphiteLine,
+		"foo.cpu.0.cpu.idle 1 yesterday":   coco.ErrGraphiteLine,
+		"foo.cpu 1 1435639791":             coco.ErrGraphiteTemplate,
+		"foo.cpu.0.cpu.idle.extra 1 12345": coco.ErrGraphiteTemplate,
+	}
+	for line, expected := range errors {
+		if _, err := coco.ParseGraphite(line, templates); err != expected {
+			t.Errorf("Expected %s parsing %s, got %v", expected, line, err)
+		}
+	}
+
+	for _, spec := range []string{"host.metric", "plugin.type", "a b c"} {
+		if _, err := coco.ParseGraphiteTemplate(spec); err == nil {
+			t.Errorf("Expected template %s to be rejected", spec)
+		}
+	}
+}
+
+func TestListenGraphite(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25976",
+		Typesdb: "../types.db",
+		Graphite: coco.GraphiteConfig{
+			Bind:      "127.0.0.1:25977",
+			Templates: []string{"host.plugin.type_instance*"},
+		},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	// Dispatch lines over both TCP and UDP
+	for _, network := range []string{"tcp", "udp"} {
+		conn, err := net.Dial(network, listenConfig.Graphite.Bind)
+		if err != nil {
+			t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Graphite.Bind, err)
+		}
+		fmt.Fprintf(conn, "%s.load.shortterm 0.5 1435639791\n%s.load.midterm 0.25 N\n", network, network)
+		conn.Close()
+	}
+
+	// Breathe a moment so samples work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 4 {
+		t.Fatalf("Expected %d samples, got %d\n", 4, len(raw))
+	}
+	hosts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		p := <-raw
+		hosts[p.Hostname]++
+		if p.Plugin != "load" {
+			t.Errorf("Expected plugin %s, got %s", "load", p.Plugin)
+		}
+	}
+	if hosts["tcp"] != 2 || hosts["udp"] != 2 {
+		t.Errorf("Expected %d samples from each of tcp and udp, got %+v", 2, hosts)
+	}
+}
+
+// statsdSamples indexes samples by host and metric name
+func statsdSamples(packets []collectd.Packet) map[string]collectd.Packet {
+	samples := map[string]collectd.Packet{}
+	for _, p := range packets {
+		samples[p.Hostname+"/"+coco.MetricName(p)] = p
+	}
+	return samples
+}
+
+func TestStatsDAggregates(t *testing.T) {
+	statsd := coco.NewStatsD(coco.StatsDConfig{
+		Host:        "foo",
+		HostTag:     "host",
+		Percentiles: []float64{50, 99.9},
+	})
+
+	lines := []string{
+		"requests:1|c",
+		"requests:2|c|@0.5",
+		"requests:1|c|#host:bar,env:prod",
+		"queue:10|g",
+		"queue:-3|g",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	}
+	for i := 1; i <= 100; i++ {
+		lines = append(lines, fmt.Sprintf("query:%d|ms", i))
+	}
+	for _, line := range lines {
+		if err := statsd.Add(line); err != nil {
+			t.Fatalf("Couldn't add %s: %s", line, err)
+		}
+	}
+	for _, line := range []string{"requests", "requests:1", "requests:x|c", "requests:1|q", "requests:1|c|@2"} {
+		if err := statsd.Add(line); err != coco.ErrStatsDLine {
+			t.Errorf("Expected %s adding %s, got %v", coco.ErrStatsDLine, line, err)
+		}
+	}
+
+	expected := map[string]float64{
+		"foo/statsd/derive/requests":               5,
+		"bar/statsd/derive/requests":               1,
+		"foo/statsd/gauge/queue":                   7,
+		"foo/statsd/objects/users":                 2,
+		"foo/statsd/latency/query-average":         0.0505,
+		"foo/statsd/latency/query-lower":           0.001,
+		"foo/statsd/latency/query-upper":           0.1,
+		"foo/statsd/latency/query-sum":             5.05,
+		"foo/statsd/gauge/query-count":             100,
+		"foo/statsd/latency/query-percentile-50":   0.05,
+		"foo/statsd/latency/query-percentile-99.9": 0.1,
+	}
+	samples := statsdSamples(statsd.Flush(time.Unix(1435639791, 0)))
+	if len(samples) != len(expected) {
+		t.Errorf("Expected %d samples, got %d: %+v", len(expected), len(samples), samples)
+	}
+	for name, value := range expected {
+		p, ok := samples[name]
+		if !ok {
+			t.Errorf("Expected a sample for %s", name)
+			continue
+		}
+		if math.Abs(p.Values[0].Value-value) > 1e-9 {
+			t.Errorf("Expected %s to be %f, got %f", name, value, p.Values[0].Value)
+		}
+		if p.Time != 1435639791 {
+			t.Errorf("Expected %s time to be %d, got %d", name, 1435639791, p.Time)
+		}
+	}
+	if samples["foo/statsd/derive/requests"].Values[0].Type != collectd.TypeDerive {
+		t.Errorf("Expected counters to be sent as derives")
+	}
+
+	// Counters and gauges carry over, timers and sets don't
+	statsd.Add("requests:1|c")
+	samples = statsdSamples(statsd.Flush(time.Unix(1435639801, 0)))
+	if len(samples) != 3 {
+		t.Errorf("Expected %d samples, got %d: %+v", 3, len(samples), samples)
+	}
+	if v := samples["foo/statsd/derive/requests"].Values[0].Value; v != 6 {
+		t.Errorf("Expected counter total of %d, got %f", 6, v)
+	}
+}
+
+func TestStatsDExpiresIdleMetrics(t *testing.T) {
+	statsd := coco.NewStatsD(coco.StatsDConfig{Host: "foo", IdleFlushes: 2})
+	now := time.Unix(1435639791, 0)
+
+	// Test
+	statsd.Add("requests:1|c")
+	statsd.Add("queue:10|g")
+	statsd.Add("errors:1|c")
+	statsd.Flush(now)
+
+	// Metrics that have gone less than idle_flushes flushes without an update
+	// are still sent
+	statsd.Add("requests:1|c")
+	samples := statsdSamples(statsd.Flush(now.Add(10 * time.Second)))
+	if len(samples) != 3 {
+		t.Errorf("Expected %d samples, got %d: %+v", 3, len(samples), samples)
+	}
+
+	// Idle metrics are forgotten
+	samples = statsdSamples(statsd.Flush(now.Add(20 * time.Second)))
+	if len(samples) != 1 {
+		t.Errorf("Expected %d sample, got %d: %+v", 1, len(samples), samples)
+	}
+	if v := samples["foo/statsd/derive/requests"].Values[0].Value; v != 2 {
+		t.Errorf("Expected counter total of %d, got %f", 2, v)
+	}
+	samples = statsdSamples(statsd.Flush(now.Add(30 * time.Second)))
+	if len(samples) != 0 {
+		t.Errorf("Expected no samples, got %d: %+v", len(samples), samples)
+	}
+
+	// Forgotten counters start again from zero
+	statsd.Add("errors:1|c")
+	samples = statsdSamples(statsd.Flush(now.Add(40 * time.Second)))
+	if v := samples["foo/statsd/derive/errors"].Values[0].Value; v != 1 {
+		t.Errorf("Expected counter total of %d, got %f", 1, v)
+	}
+}
+
+func TestListenStatsD(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25978",
+		Typesdb: "../types.db",
+		StatsD: coco.StatsDConfig{
+			Bind:          "127.0.0.1:25979",
+			FlushInterval: coco.Duration{Duration: 50 * time.Millisecond},
+			Host:          "foo",
+		},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.StatsD.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.StatsD.Bind, err)
+	}
+	conn.Write([]byte("requests:1|c\nrequests:1|c\n"))
+
+	// Wait for a flush with the counter in it
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case p := <-raw:
+			if p.Hostname != "foo" || p.Type != "derive" {
+				t.Fatalf("Expected a derive from %s, got %+v", "foo", p)
+			}
+			if p.Values[0].Value == 2 {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected a counter of %d to be flushed", 2)
+		}
+	}
+}
+
+func TestParseInflux(t *testing.T) {
+	line := `disk\ io,host=foo,device=sda,path=/var\,log reads=10i,busy=t,label="a b,c=d",util=0.5 1435639791000000000`
+	packets, err := coco.ParseInflux(line, "host", time.Nanosecond)
+	if err != nil {
+		t.Fatalf("Couldn't parse %s: %s", line, err)
+	}
+
+	expected := map[string]float64{
+		"foo/disk io/sda-/var,log/gauge/reads": 10,
+		"foo/disk io/sda-/var,log/gauge/busy":  1,
+		"foo/disk io/sda-/var,log/gauge/util":  0.5,
+	}
+	if len(packets) != len(expected) {
+		t.Fatalf("Expected %d samples, got %d: %+v", len(expected), len(packets), packets)
+	}
+	for _, p := range packets {
+		name := p.Hostname + "/" + coco.MetricName(p)
+		value, ok := expected[name]
+		if !ok {
+			t.Errorf("Unexpected sample %s", name)
+			continue
+		}
+		if p.Values[0].Value != value {
+			t.Errorf("Expected %s to be %f, got %f", name, value, p.Values[0].Value)
+		}
+		if p.Time != 1435639791 {
+			t.Errorf("Expected %s time to be %d, got %d", name, 1435639791, p.Time)
+		}
+	}
+
+	// The host tag is configurable, and timestamps can have other precisions
+	packets, err = coco.ParseInflux("load,node=bar shortterm=0.1 1435639791", "node", time.Second)
+	if err != nil {
+		t.Fatalf("Couldn't parse line: %s", err)
+	}
+	if p := packets[0]; p.Hostname != "bar" || p.Time != 1435639791 {
+		t.Errorf("Expected host %s at %d, got %s at %d", "bar", 1435639791, p.Hostname, p.Time)
+	}
+
+	errors := map[string]error{
+		"load shortterm=0.1":                   coco.ErrInfluxHost,
+		"load,node=bar shortterm=0.1":          coco.ErrInfluxHost,
+		"load,host=foo":                        coco.ErrInfluxLine,
+		"load,host=foo shortterm=":             coco.ErrInfluxLine,
+		"load,host=foo shortterm=abc":          coco.ErrInfluxLine,
+		"load,host=foo shortterm=0.1 tomorrow": coco.ErrInfluxLine,
+		"load,host shortterm=0.1":              coco.ErrInfluxLine,
+	}
+	for line, expected := range errors {
+		if _, err := coco.ParseInflux(line, "host", time.Nanosecond); err != expected {
+			t.Errorf("Expected %s parsing %s, got %v", expected, line, err)
+		}
+	}
+}
+
+func TestListenInfluxDB(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:     "127.0.0.1:25980",
+		Typesdb:  "../types.db",
+		InfluxDB: coco.InfluxDBConfig{Bind: "127.0.0.1:25981"},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+	poll(t, listenConfig.InfluxDB.Bind)
+
+	// Write over HTTP
+	url := "http://" + listenConfig.InfluxDB.Bind + "/write?db=telegraf&precision=s"
+	body := "cpu,host=foo,cpu=cpu0 usage_idle=98.5,usage_user=1.5 1435639791\n"
+	resp, err := http.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("HTTP POST failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	// Valid lines are still written when others are rejected
+	body = "cpu usage_idle=98.5\ncpu,host=bar usage_idle=50\n"
+	resp, err = http.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("HTTP POST failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Write over UDP
+	conn, err := net.Dial("udp", listenConfig.InfluxDB.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.InfluxDB.Bind, err)
+	}
+	conn.Write([]byte("mem,host=baz free=1024i\n"))
+
+	// Breathe a moment so samples work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 4 {
+		t.Fatalf("Expected %d samples, got %d\n", 4, len(raw))
+	}
+	hosts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		p := <-raw
+		hosts[p.Hostname]++
+	}
+	if hosts["foo"] != 2 || hosts["bar"] != 1 || hosts["baz"] != 1 {
+		t.Errorf("Expected samples from foo, bar, and baz, got %+v", hosts)
+	}
+}
+
+func TestParsePutval(t *testing.T) {
+	types, err := collectd.TypesDBFile("../types.db")
+	if err != nil {
+		t.Fatalf("Couldn't parse types.db: %s", err)
+	}
+
+	packets, err := coco.ParsePutval(`PUTVAL "foo/cpu-0/cpu-idle" interval=10.000 1435639791.123:1901474177 1435639801:1901475177`, types)
+	if err != nil {
+		t.Fatalf("Couldn't parse PUTVAL: %s", err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected %d samples, got %d", 2, len(packets))
+	}
+	p := packets[0]
+	if name := p.Hostname + "/" + coco.MetricName(p); name != "foo/cpu/0/cpu/idle" {
+		t.Errorf("Expected %s, got %s", "foo/cpu/0/cpu/idle", name)
+	}
+	if p.Time != 1435639791 || p.Interval != 10 || packets[1].Time != 1435639801 {
+		t.Errorf("Expected times of %d and %d, interval %d, got %+v", 1435639791, 1435639801, 10, packets)
+	}
+	if p.Values[0].Type != collectd.TypeDerive || p.Values[0].Value != 1901474177 {
+		t.Errorf("Expected derive of %d, got %+v", 1901474177, p.Values)
+	}
+
+	// Multiple data sources, and undefined gauges
+	packets, err = coco.ParsePutval("PUTVAL foo/load/load N:0.5:U:0.25", types)
+	if err != nil {
+		t.Fatalf("Couldn't parse PUTVAL: %s", err)
+	}
+	values := packets[0].Values
+	if len(values) != 3 || values[0].Value != 0.5 || !math.IsNaN(values[1].Value) || values[2].Name != "longterm" {
+		t.Errorf("Expected load values, got %+v", values)
+	}
+
+	errors := map[string]error{
+		"PUTVAL foo/load/load":                    coco.ErrPutval,
+		"PUTVAL foo/load 1435639791:1:1:1":        coco.ErrPutval,
+		"PUTVAL foo/load/load 1435639791:1":       coco.ErrPutval,
+		"PUTVAL foo/load/load yesterday:1:1:1":    coco.ErrPutval,
+		"PUTNOTIF foo/load/load 1435639791:1":     coco.ErrPutval,
+		"PUTVAL foo/load/nonexistent N:1":         collectd.ErrorUnknownType,
+		"PUTVAL foo/cpu-0/cpu-idle N:U":           coco.ErrPutval,
+		"PUTVAL foo/load/load interval=x N:1:1:1": coco.ErrPutval,
+	}
+	for line, expected := range errors {
+		if _, err := coco.ParsePutval(line, types); err != expected {
+			t.Errorf("Expected %s parsing %s, got %v", expected, line, err)
+		}
+	}
+}
+
+func TestApiAcceptsWriteHTTP(t *testing.T) {
+	// Setup Api
+	config := coco.Config{
+		Listen: coco.ListenConfig{Typesdb: "../types.db"},
+		Filter: coco.FilterConfig{Blacklist: "/(irq)/"},
+		Api:    coco.ApiConfig{Bind: "127.0.0.1:26084"},
+	}
+	raw := make(chan collectd.Packet, 500)
+	var tiers []coco.Tier
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(config, nil, nil, nil, &tiers, blacklisted, raw)
+	poll(t, config.Api.Bind)
+
+	post := func(contentType string, body string) (int, coco.WriteResult) {
+		resp, err := http.Post("http://"+config.Api.Bind+"/collectd", contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("HTTP POST failed: %s", err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		var result coco.WriteResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			t.Fatalf("Error when decoding JSON %+v: %s", err, string(data))
+		}
+		return resp.StatusCode, result
+	}
+
+	// JSON format
+	body := `[
+	  {"values":[1901474177],"dstypes":["derive"],"dsnames":["value"],"time":1435639791.123,"interval":10.000,"host":"foo","plugin":"cpu","plugin_instance":"0","type":"cpu","type_instance":"idle"},
+	  {"values":[null],"dstypes":["gauge"],"dsnames":["value"],"time":1435639791,"interval":10,"host":"foo","plugin":"irq","plugin_instance":"","type":"irq","type_instance":"0"},
+	  {"values":[1,2],"dstypes":["gauge"],"dsnames":["value"],"time":1435639791,"interval":10,"host":"foo","plugin":"bad","type":"gauge"}
+	]`
+	code, result := post("application/json", body)
+	expected := coco.WriteResult{Queued: 2, Denied: 1, Invalid: 1}
+	if code != http.StatusOK || result != expected {
+		t.Errorf("Expected %d %+v, got %d %+v", http.StatusOK, expected, code, result)
+	}
+
+	// Writes that queue nothing are failures
+	body = `[{"values":[1,2],"dstypes":["gauge"],"dsnames":["value"],"time":1435639791,"interval":10,"host":"foo","plugin":"bad","type":"gauge"}]`
+	code, result = post("application/json", body)
+	expected = coco.WriteResult{Invalid: 1}
+	if code != http.StatusBadRequest || result != expected {
+		t.Errorf("Expected %d %+v, got %d %+v", http.StatusBadRequest, expected, code, result)
+	}
+
+	// Command format
+	body = "PUTVAL \"bar/load/load\" interval=10.000 1435639791:0.5:0.25:0.1\nPUTVAL bar/irq/irq-0 interval=10.000 N:1\n"
+	code, result = post("text/plain", body)
+	expected = coco.WriteResult{Queued: 2, Denied: 1}
+	if code != http.StatusOK || result != expected {
+		t.Errorf("Expected %d %+v, got %d %+v", http.StatusOK, expected, code, result)
+	}
+
+	// Denied samples are still queued, so Filter can blacklist them
+	if len(raw) != 4 {
+		t.Fatalf("Expected %d samples, got %d\n", 4, len(raw))
+	}
+	p := <-raw
+	if p.Hostname != "foo" || p.Time != 1435639791 || p.Values[0].Type != collectd.TypeDerive {
+		t.Errorf("Expected a derive from foo at %d, got %+v", 1435639791, p)
+	}
+
+	// Samples that don't fit in the queue are rejected, rather than blocking
+	for len(raw) < cap(raw) {
+		raw <- collectd.Packet{}
+	}
+	code, result = post("text/plain", "PUTVAL bar/load/load interval=10.000 N:0.5:0.25:0.1\n")
+	expected = coco.WriteResult{Rejected: 1}
+	if code != http.StatusServiceUnavailable || result != expected {
+		t.Errorf("Expected %d %+v, got %d %+v", http.StatusServiceUnavailable, expected, code, result)
+	}
+}
+
+func TestNotificationsRoundTrip(t *testing.T) {
+	expected := coco.Notification{
+		Hostname:     "foo",
+		Plugin:       "load",
+		Type:         "load",
+		TypeInstance: "shortterm",
+		Time:         1435639791,
+		Severity:     coco.SeverityWarning,
+		Message:      "Host foo, plugin load type load (instance shortterm): Data source \"value\" is currently 5.000000.",
+	}
+	buf, err := coco.EncodeNotification(expected)
+	if err != nil {
+		t.Fatalf("Couldn't encode notification: %s", err)
+	}
+
+	// Append a notification with an invalid severity, and a sample
+	invalid := expected
+	invalid.Severity = 3
+	b, _ := coco.EncodeNotification(invalid)
+	buf = append(buf, b...)
+	b, _ = coco.Encode(collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"})
+	buf = append(buf, b...)
+
+	notifications, err := coco.Notifications(buf)
+	if err != nil {
+		t.Fatalf("Couldn't find notifications: %s", err)
+	}
+	if len(notifications) != 1 {
+		t.Fatalf("Expected %d notification, got %d: %+v", 1, len(notifications), notifications)
+	}
+	if notifications[0] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, notifications[0])
+	}
+
+	// Samples in the same packet are still decoded
+	types, _ := collectd.TypesDBFile("../types.db")
+	packets, err := collectd.Packets(buf, types)
+	if err != nil || len(*packets) != 1 {
+		t.Errorf("Expected %d sample, got %v: %s", 1, packets, err)
+	}
+}
+
+func TestNotificationsAreRouted(t *testing.T) {
+	// Setup a target to receive notifications
+	targetConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25982",
+		Typesdb: "../types.db",
+	}
+	received := make(chan coco.Notification, 10)
+	go coco.Listen(targetConfig, nil, nil, make(chan collectd.Packet, 10), received)
+
+	// Setup a webhook
+	posted := make(chan coco.Notification, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n coco.Notification
+		json.NewDecoder(r.Body).Decode(&n)
+		posted <- n
+	}))
+	defer webhook.Close()
+
+	// Setup listen, send, and api
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25983",
+		Typesdb: "../types.db",
+	}
+	raw := make(chan collectd.Packet, 10)
+	notifications := make(chan coco.Notification, 10)
+	go coco.Listen(listenConfig, nil, nil, raw, notifications)
+
+	tiers := []coco.Tier{
+		coco.Tier{Name: "a", Targets: []string{targetConfig.Bind}},
+	}
+	sendConfig := coco.SendConfig{NotificationWebhook: webhook.URL}
+	go coco.Send(sendConfig, &tiers, make(chan collectd.Packet), notifications)
+
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26085",
+	}
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+	expected := coco.Notification{
+		Hostname: "foo",
+		Plugin:   "df",
+		Type:     "percent_bytes",
+		Time:     1435639791,
+		Severity: coco.SeverityFailure,
+		Message:  "Disk is full",
+	}
+	buf, _ := coco.EncodeNotification(expected)
+	conn.Write(buf)
+
+	for name, c := range map[string]chan coco.Notification{"target": received, "webhook": posted} {
+		select {
+		case n := <-c:
+			if n != expected {
+				t.Errorf("Expected %s to get %+v, got %+v", name, expected, n)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %s to get a notification", name)
+		}
+	}
+
+	resp, err := http.Get("http://" + apiConfig.Bind + "/notifications")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var result []coco.Notification
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if len(result) == 0 || result[len(result)-1] != expected {
+		t.Errorf("Expected %+v to be the latest notification, got %+v", expected, result)
+	}
+}
+
+func TestUDPSocketStats(t *testing.T) {
+	proc := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  523: 0100007F:64E2 00000000:0000 07 00000000:00000A00 00:00000000 00000000     0        0 1001 2 0000000000000000 7
+  523: 0100007F:64E2 00000000:0000 07 00000000:00000100 00:00000000 00000000     0        0 1002 2 0000000000000000 5
+  600: 00000000:0044 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 2001 2 0000000000000000 99
+`
+	rxQueue, drops, err := coco.UDPSocketStats(strings.NewReader(proc), map[uint64]bool{1001: true, 1002: true})
+	if err != nil {
+		t.Fatalf("Couldn't parse socket stats: %s", err)
+	}
+	if rxQueue != 0xA00+0x100 {
+		t.Errorf("Expected rx_queue of %d, got %d", 0xA00+0x100, rxQueue)
+	}
+	if drops != 12 {
+		t.Errorf("Expected %d drops, got %d", 12, drops)
+	}
+}
+
+func TestListenReaders(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:       "127.0.0.1:25984",
+		Typesdb:    "../types.db",
+		Readers:    4,
+		ReadBuffer: 1 << 20,
+	}
+	raw := make(chan collectd.Packet, 10000)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so the listener is bound
+	time.Sleep(100 * time.Millisecond)
+
+	// Dispatch from enough sockets that the kernel spreads them across every
+	// reader
+	payload, _ := coco.Encode(collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"})
+	sent := 0
+	for i := 0; i < 64; i++ {
+		conn, err := net.Dial("udp", listenConfig.Bind)
+		if err != nil {
+			t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+		}
+		for j := 0; j < 20; j++ {
+			conn.Write(payload)
+			sent++
+		}
+		conn.Close()
+	}
+
+	// Wait for packets to work their way through, or be dropped by the kernel
+	drops := 0
+	for i := 0; i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		drops = kernelDrops(t, listenConfig.Bind)
+		if len(raw)+drops >= sent {
+			break
+		}
+	}
+
+	if len(raw) != sent-drops {
+		t.Errorf("Expected %d packets, %d sent less %d dropped, got %d\n", sent-drops, sent, drops, len(raw))
+	}
+	for i := 0; i < listenConfig.Readers; i++ {
+		if n := counter("coco.listen", "reader."+strconv.Itoa(i)); n == 0 {
+			t.Errorf("Expected reader %d to receive packets", i)
+		}
+	}
+	if expvar.Get("coco.listen").(*expvar.Map).Get("kernel.drops") == nil {
+		t.Errorf("Expected coco.listen.kernel.drops to be exported")
+	}
+}
+
+// kernelDrops sums the drops from /proc/net/udp for the sockets bound to an
+// address, skipping the test if there's no /proc/net/udp.
+func kernelDrops(t *testing.T, bind string) int {
+	data, err := ioutil.ReadFile("/proc/net/udp")
+	if err != nil {
+		t.Skipf("Couldn't read kernel drops: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(bind)
+	n, _ := strconv.Atoi(port)
+	local := fmt.Sprintf(":%04X", n)
+
+	drops := 0
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 13 || !strings.HasSuffix(fields[1], local) {
+			continue
+		}
+		d, _ := strconv.Atoi(fields[len(fields)-1])
+		drops += d
+	}
+	return drops
+}
+
+var benchmarkListeners = map[int]*int64{}
+
+// benchmarkListen measures how many packets Listen can receive with a number
+// of readers, while several clients send as fast as they can.
+func benchmarkListen(b *testing.B, readers int) {
+	bind := "127.0.0.1:" + strconv.Itoa(25990+readers)
+	received, ok := benchmarkListeners[readers]
+	if !ok {
+		received = new(int64)
+		benchmarkListeners[readers] = received
+		raw := make(chan collectd.Packet, 100000)
+		go coco.Listen(coco.ListenConfig{
+			Bind:       bind,
+			Typesdb:    "../types.db",
+			Readers:    readers,
+			ReadBuffer: 8 << 20,
+		}, nil, nil, raw, nil)
+		go func() {
+			for range raw {
+				atomic.AddInt64(received, 1)
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var packet []byte
+	for i := 0; i < 10; i++ {
+		p, _ := coco.Encode(collectd.Packet{Hostname: "foo", Plugin: "cpu", PluginInstance: strconv.Itoa(i), Type: "cpu", TypeInstance: "idle",
+			Values: []collectd.Value{{Name: "value", Type: collectd.TypeDerive, Value: 1}}})
+		packet = append(packet, p...)
+	}
+
+	start := atomic.LoadInt64(received)
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	senders := 8
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			conn, err := net.Dial("udp", bind)
+			if err != nil {
+				b.Errorf("Couldn't establish connection to %s: %s", bind, err)
+				return
+			}
+			defer conn.Close()
+			for j := 0; j < n; j++ {
+				conn.Write(packet)
+			}
+		}(b.N / senders)
+	}
+	wg.Wait()
+
+	// Wait for the readers to drain the socket buffers
+	for last := int64(-1); ; {
+		time.Sleep(50 * time.Millisecond)
+		n := atomic.LoadInt64(received)
+		if n == last {
+			break
+		}
+		last = n
+	}
+	b.StopTimer()
+	samples := atomic.LoadInt64(received) - start
+	b.ReportMetric(float64(samples)/10/float64(b.N/senders*senders), "delivered/op")
+}
+
+func BenchmarkListen1Reader(b *testing.B) {
+	benchmarkListen(b, 1)
+}
+
+func BenchmarkListen4Readers(b *testing.B) {
+	benchmarkListen(b, 4)
+}
+
+func TestListenCapturesMalformedPackets(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25985",
+		Typesdb: "../types.db",
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26086",
+	}
+	var tiers []coco.Tier
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+
+	invalid := counter("coco.errors", "listen.decode.invalid")
+	unknown := counter("coco.errors", "listen.decode.unknown_type")
+
+	// Dispatch a sample with an unknown value type, a truncated part, a part
+	// that's too short, and finally a valid sample
+	unknownType, _ := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+		Values:   []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}},
+	})
+	// The value type comes after the values part's header and value count
+	unknownType[len(unknownType)-9] = 9
+	conn.Write(unknownType)
+	conn.Write([]byte{0x00, 0x00, 0x00})
+	conn.Write([]byte{0x00, 0x00, 0x00, 0x04, 0x00})
+	valid, _ := coco.Encode(collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"})
+	conn.Write(valid)
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+	if len(raw) != 1 {
+		t.Fatalf("Expected %d packets, got %d\n", 1, len(raw))
+	}
+	if n := counter("coco.errors", "listen.decode.invalid") - invalid; n != 2 {
+		t.Errorf("Expected coco.errors.listen.decode.invalid to increase by %d, increased by %d", 2, n)
+	}
+	if n := counter("coco.errors", "listen.decode.unknown_type") - unknown; n != 1 {
+		t.Errorf("Expected coco.errors.listen.decode.unknown_type to increase by %d, increased by %d", 1, n)
+	}
+
+	// Fetch the malformed packets
+	resp, err := http.Get("http://" + apiConfig.Bind + "/debug/malformed")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var result []coco.Malformed
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if len(result) < 3 {
+		t.Fatalf("Expected at least %d malformed packets, got %d", 3, len(result))
+	}
+	result = result[len(result)-3:]
+	expected := []string{hex.EncodeToString(unknownType), "000000", "0000000400"}
+	for i, m := range result {
+		if m.Source != conn.LocalAddr().String() {
+			t.Errorf("Expected source %s, got %s", conn.LocalAddr(), m.Source)
+		}
+		if m.Payload != expected[i] {
+			t.Errorf("Expected payload %s, got %s", expected[i], m.Payload)
+		}
+	}
+	if result[0].Error != collectd.ErrorUnknownType.Error() {
+		t.Errorf("Expected error %s, got %s", collectd.ErrorUnknownType, result[0].Error)
+	}
+}
+
+func TestTypesDBReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	custom := filepath.Join(dir, "custom.db")
+	if err := ioutil.WriteFile(custom, []byte("load value:GAUGE:0:U\n"), 0644); err != nil {
+		t.Fatalf("Couldn't write %s: %s", custom, err)
+	}
+
+	// Types in later files override types in earlier files
+	db, err := coco.LoadTypesDB([]string{"../types.db", custom})
+	if err != nil {
+		t.Fatalf("Couldn't load types.db: %s", err)
+	}
+	if n := len(db.Types()["load"]); n != 1 {
+		t.Errorf("Expected load to have %d data source, got %d", 1, n)
+	}
+	if _, ok := db.Types()["widgets"]; ok {
+		t.Errorf("Expected widgets to be unknown before reload")
+	}
+
+	// Add a type, and reload
+	data := []byte("load value:GAUGE:0:U\nwidgets value:GAUGE:0:U\n")
+	if err := ioutil.WriteFile(custom, data, 0644); err != nil {
+		t.Fatalf("Couldn't write %s: %s", custom, err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Fatalf("Couldn't reload types.db: %s", err)
+	}
+	if _, ok := db.Types()["widgets"]; !ok {
+		t.Errorf("Expected widgets to be known after reload")
+	}
+	if _, ok := db.Types()["cpu"]; !ok {
+		t.Errorf("Expected cpu to still be known after reload")
+	}
+
+	// Types are kept if a file can't be read
+	os.Remove(custom)
+	if err := db.Reload(); err == nil {
+		t.Errorf("Expected an error reloading a missing types.db")
+	}
+	if _, ok := db.Types()["widgets"]; !ok {
+		t.Errorf("Expected widgets to be kept after a failed reload")
+	}
+}
+
+func TestListenTracksUnknownTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	custom := filepath.Join(dir, "custom.db")
+	if err := ioutil.WriteFile(custom, []byte("widgets value:GAUGE:0:U\n"), 0644); err != nil {
+		t.Fatalf("Couldn't write %s: %s", custom, err)
+	}
+
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:         "127.0.0.1:25986",
+		Typesdb:      "../types.db",
+		TypesdbFiles: []string{custom},
+	}
+	// types.db is shared by Listen and the Api
+	types, err := coco.WatchTypesDB(listenConfig)
+	if err != nil {
+		t.Fatalf("Couldn't load types.db: %s", err)
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, types, raw, nil)
+
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26087",
+	}
+	var tiers []coco.Tier
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Listen: listenConfig, Api: apiConfig}, nil, nil, types, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+
+	// Dispatch samples with known types, and a custom type that isn't known
+	for _, sample := range []collectd.Packet{
+		{Hostname: "foo", Plugin: "load", Type: "load"},
+		{Hostname: "foo", Plugin: "custom", Type: "widgets"},
+		{Hostname: "foo", Plugin: "custom", Type: "gizmos"},
+		{Hostname: "bar", Plugin: "custom", Type: "gizmos"},
+		{Hostname: "bar", Plugin: "custom", Type: "gizmos"},
+	} {
+		sample.Values = []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}}
+		buf, _ := coco.Encode(sample)
+		conn.Write(buf)
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	// Samples with unknown types are still passed on
+	if len(raw) != 5 {
+		t.Fatalf("Expected %d packets, got %d\n", 5, len(raw))
+	}
+
+	// Fetch the unknown types
+	resp, err := http.Get("http://" + apiConfig.Bind + "/types/unknown")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var result map[string]coco.UnknownType
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if _, ok := result["widgets"]; ok {
+		t.Errorf("Expected widgets not to be unknown: %+v", result)
+	}
+	gizmos, ok := result["gizmos"]
+	if !ok {
+		t.Fatalf("Expected gizmos to be unknown: %+v", result)
+	}
+	if gizmos.Count != 3 {
+		t.Errorf("Expected gizmos count to be %d, got %d", 3, gizmos.Count)
+	}
+	if gizmos.Hosts["foo"] != 1 || gizmos.Hosts["bar"] != 2 {
+		t.Errorf("Expected gizmos from foo once and bar twice, got %+v", gizmos.Hosts)
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := coco.NewACL(coco.ListenConfig{
+		Allow: []string{"10.0.0.0/8", "192.168.1.10"},
+		Deny:  []string{"10.1.0.0/16"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't build ACL: %s", err)
+	}
+
+	examples := map[string]bool{
+		"10.0.0.1":     true,
+		"10.1.0.1":     false,
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+		"127.0.0.1":    false,
+	}
+	denied := counter("coco.listen", "acl.deny.10.1.0.0/16")
+	notAllowed := counter("coco.listen", "acl.not_allowed")
+	for addr, expected := range examples {
+		if allowed := acl.Allowed(net.ParseIP(addr)); allowed != expected {
+			t.Errorf("Expected %s allowed to be %t, got %t", addr, expected, allowed)
+		}
+	}
+	if n := counter("coco.listen", "acl.deny.10.1.0.0/16") - denied; n != 1 {
+		t.Errorf("Expected coco.listen.acl.deny.10.1.0.0/16 to increase by %d, increased by %d", 1, n)
+	}
+	if n := counter("coco.listen", "acl.not_allowed") - notAllowed; n != 2 {
+		t.Errorf("Expected coco.listen.acl.not_allowed to increase by %d, increased by %d", 2, n)
+	}
+
+	// Invalid CIDRs are rejected
+	if _, err := coco.NewACL(coco.ListenConfig{Deny: []string{"10.0.0.0/33"}}, nil); err == nil {
+		t.Errorf("Expected an error for an invalid CIDR")
+	}
+}
+
+func TestListenACL(t *testing.T) {
+	// Setup listen, only accepting packets from a network we're not on
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25987",
+		Typesdb: "../types.db",
+		Allow:   []string{"10.0.0.0/8"},
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Setup another listen, with hosts bound to where their samples come from
+	boundConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25988",
+		Typesdb: "../types.db",
+		HostCIDRs: map[string][]string{
+			"foo": []string{"127.0.0.0/8"},
+			"bar": []string{"10.0.0.0/8"},
+		},
+	}
+	bound := make(chan collectd.Packet, 500)
+	go coco.Listen(boundConfig, nil, nil, bound, nil)
+
+	// Breathe a moment so Listen can start
+	time.Sleep(100 * time.Millisecond)
+
+	rejected := counter("coco.listen", "acl.not_allowed")
+	spoofed := counter("coco.listen", "acl.host.bar")
+
+	for _, bind := range []string{listenConfig.Bind, boundConfig.Bind} {
+		conn, err := net.Dial("udp", bind)
+		if err != nil {
+			t.Fatalf("Couldn't establish connection to %s: %s", bind, err)
+		}
+		for _, host := range []string{"foo", "bar", "baz"} {
+			buf, _ := coco.Encode(collectd.Packet{Hostname: host, Plugin: "load", Type: "load"})
+			conn.Write(buf)
+		}
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	if len(raw) != 0 {
+		t.Errorf("Expected %d packets from a source that isn't allowed, got %d\n", 0, len(raw))
+	}
+	if n := counter("coco.listen", "acl.not_allowed") - rejected; n != 3 {
+		t.Errorf("Expected coco.listen.acl.not_allowed to increase by %d, increased by %d", 3, n)
+	}
+
+	if len(bound) != 2 {
+		t.Fatalf("Expected %d packets, got %d\n", 2, len(bound))
+	}
+	for i := 0; i < 2; i++ {
+		if p := <-bound; p.Hostname == "bar" {
+			t.Errorf("Expected samples for bar to be dropped")
+		}
+	}
+	if n := counter("coco.listen", "acl.host.bar") - spoofed; n != 1 {
+		t.Errorf("Expected coco.listen.acl.host.bar to increase by %d, increased by %d", 1, n)
+	}
+}
+
+func TestNormaliseHostname(t *testing.T) {
+	normaliser, err := coco.NewNormaliser(coco.NormaliseConfig{
+		Lowercase:    true,
+		TrimDot:      true,
+		StripDomain:  []string{"example.org", ".example.net"},
+		AppendDomain: "example.com",
+		Rewrite: []coco.RewriteConfig{
+			{Pattern: `^db-(\d+)`, Replacement: "db$1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't build normaliser: %s", err)
+	}
+
+	examples := map[string]string{
+		"web01":                "web01.example.com",
+		"WEB01.example.org":    "web01.example.com",
+		"web01.example.org.":   "web01.example.com",
+		"web01.EXAMPLE.NET":    "web01.example.com",
+		"web01.example.com":    "web01.example.com",
+		"web01.example.io":     "web01.example.io",
+		"db-01.example.org":    "db01.example.com",
+		"example.org.internal": "example.org.internal",
+	}
+	for host, expected := range examples {
+		if actual := normaliser.Hostname(host); actual != expected {
+			t.Errorf("Expected %s to normalise to %s, got %s", host, expected, actual)
+		}
+	}
+
+	// Nothing is changed by default
+	normaliser, _ = coco.NewNormaliser(coco.NormaliseConfig{})
+	if actual := normaliser.Hostname("WEB01.example.org."); actual != "WEB01.example.org." {
+		t.Errorf("Expected hostname to be unchanged, got %s", actual)
+	}
+
+	// Invalid patterns are rejected
+	_, err = coco.NewNormaliser(coco.NormaliseConfig{
+		Rewrite: []coco.RewriteConfig{{Pattern: "("}},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for an invalid rewrite pattern")
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	// Setup normalise
+	config := coco.NormaliseConfig{Lowercase: true, TrimDot: true}
+	raw := make(chan collectd.Packet)
+	normalised := make(chan collectd.Packet)
+	go coco.Normalise(config, raw, normalised)
+
+	// Variants of a hostname are all hashed to the same name
+	for _, host := range []string{"web01.example.org", "WEB01.example.org", "web01.example.org."} {
+		raw <- collectd.Packet{Hostname: host, Plugin: "load", Type: "load"}
+		select {
+		case p := <-normalised:
+			if p.Hostname != "web01.example.org" {
+				t.Errorf("Expected %s to be normalised to %s, got %s", host, "web01.example.org", p.Hostname)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s to be normalised", host)
+		}
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	config := coco.FilterConfig{
+		Blacklist: "/(irq)/",
+		Rules: []coco.RuleConfig{
+			{Name: "keep-db-disk", Action: "allow", Host: `^db\d+$`, Plugin: "^disk$"},
+			{Name: "drop-disk", Action: "deny", Plugin: "^disk$"},
+			{Action: "deny", Plugin: "^cpu$", TypeInstance: "^(nice|steal)$"},
+		},
+	}
+	rules, err := coco.CompileRules(config)
+	if err != nil {
+		t.Fatalf("Couldn't compile rules: %s", err)
+	}
+
+	examples := []struct {
+		packet  collectd.Packet
+		allowed bool
+		rule    string
+	}{
+		{collectd.Packet{Hostname: "db01", Plugin: "disk", Type: "disk_octets"}, true, "keep-db-disk"},
+		{collectd.Packet{Hostname: "web01", Plugin: "disk", Type: "disk_octets"}, false, "drop-disk"},
+		{collectd.Packet{Hostname: "web01", Plugin: "cpu", Type: "cpu", TypeInstance: "steal"}, false, "2"},
+		{collectd.Packet{Hostname: "web01", Plugin: "cpu", Type: "cpu", TypeInstance: "user"}, true, ""},
+		{collectd.Packet{Hostname: "web01", Plugin: "irq", Type: "irq", TypeInstance: "7"}, false, "blacklist"},
+		{collectd.Packet{Hostname: "db01", Plugin: "load", Type: "load"}, true, ""},
+	}
+	for _, e := range examples {
+		allowed, rule := rules.Allowed(e.packet)
+		if allowed != e.allowed {
+			t.Errorf("Expected %+v allowed to be %t, got %t", e.packet, e.allowed, allowed)
+		}
+		var name string
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != e.rule {
+			t.Errorf("Expected %+v to match rule '%s', matched '%s'", e.packet, e.rule, name)
+		}
+	}
+	for _, rule := range rules {
+		if rule.Name == "drop-disk" && rule.Hits() != 1 {
+			t.Errorf("Expected drop-disk to have %d hit, got %d", 1, rule.Hits())
+		}
+	}
+
+	// Invalid rules are rejected
+	invalid := []coco.RuleConfig{
+		{Action: "maybe"},
+		{Action: "deny", Host: "("},
+	}
+	for _, rc := range invalid {
+		if _, err := coco.CompileRules(coco.FilterConfig{Rules: []coco.RuleConfig{rc}}); err == nil {
+			t.Errorf("Expected an error compiling %+v", rc)
+		}
+	}
+}
+
+// filterSamples are a mix of samples for benchmarking the filter.
+func filterSamples() []collectd.Packet {
+	var samples []collectd.Packet
+	for _, plugin := range []string{"cpu", "memory", "irq", "disk", "interface", "load", "vmem", "users"} {
+		samples = append(samples, collectd.Packet{
+			Hostname:     "web01.example.org",
+			Plugin:       plugin,
+			Type:         plugin,
+			TypeInstance: "7",
+		})
+	}
+	return samples
+}
+
+// BenchmarkFilterRecompile filters samples the way Filter did before rules,
+// compiling the blacklist for every sample.
+func BenchmarkFilterRecompile(b *testing.B) {
+	blacklist := "/(vmem|irq|entropy|users)/"
+	samples := filterSamples()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := samples[i%len(samples)]
+		re := regexp.MustCompile(blacklist)
+		re.FindStringIndex(p.Hostname + "/" + coco.MetricName(p))
+	}
+}
+
+func BenchmarkFilterRules(b *testing.B) {
+	rules, _ := coco.CompileRules(coco.FilterConfig{
+		Blacklist: "/(vmem|irq|entropy|users)/",
+		Rules: []coco.RuleConfig{
+			{Action: "allow", Host: `^db\d+`, Plugin: "^disk$"},
+			{Action: "deny", Plugin: "^(entropy|users)$"},
+		},
+	})
+	samples := filterSamples()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rules.Allowed(samples[i%len(samples)])
+	}
+}
+
+func TestTierRouting(t *testing.T) {
+	// Setup targets that record the metrics they receive
+	received := map[string]chan string{}
+	for _, addr := range []string{"127.0.0.1:25989", "127.0.0.1:25990"} {
+		laddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal("Couldn't resolve address", err)
+		}
+		target, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Fatalf("Couldn't listen to %s: %s", laddr, err)
+		}
+		names := make(chan string, 100)
+		received[addr] = names
+		go func() {
+			for {
+				buf := make([]byte, coco.MaxPacketSize)
+				n, err := target.Read(buf)
+				if err != nil {
+					return
+				}
+				frames, _ := coco.Split(buf[0:n])
+				for _, f := range frames {
+					names <- coco.MetricName(f.Packet)
+				}
+			}
+		}()
+	}
+
+	// Setup sender, with a long term tier that only stores some metrics, and a
+	// short term tier that stores everything but irq
+	tiers := []coco.Tier{
+		{Name: "long", Targets: []string{"127.0.0.1:25989"}, Include: []string{"^(cpu|memory|df|interface)/"}},
+		{Name: "short", Targets: []string{"127.0.0.1:25990"}, Exclude: []string{"^irq/"}},
+	}
+	var sendConfig coco.SendConfig
+	sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
+	filtered := make(chan collectd.Packet)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
+
+	// Setup API
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26088",
+	}
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	excluded := counter("coco.tiers.excluded", "long")
+
+	// Test
+	for _, plugin := range []string{"cpu", "irq", "load", "memory"} {
+		filtered <- collectd.Packet{
+			Hostname: "foo",
+			Plugin:   plugin,
+			Type:     plugin,
+			Values:   []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}},
+		}
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	expected := map[string][]string{
+		"127.0.0.1:25989": []string{"cpu/cpu", "memory/memory"},
+		"127.0.0.1:25990": []string{"cpu/cpu", "load/load", "memory/memory"},
+	}
+	for addr, names := range expected {
+		var actual []string
+		for len(received[addr]) > 0 {
+			actual = append(actual, <-received[addr])
+		}
+		if !reflect.DeepEqual(actual, names) {
+			t.Errorf("Expected %s to receive %v, got %v", addr, names, actual)
+		}
+	}
+	if n := counter("coco.tiers.excluded", "long") - excluded; n != 2 {
+		t.Errorf("Expected coco.tiers.excluded.long to increase by %d, increased by %d", 2, n)
+	}
+
+	// Lookup reports whether the metric is stored in each tier
+	resp, err := http.Get("http://" + apiConfig.Bind + "/lookup?name=foo&metric=irq/irq")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var result map[string]coco.TierRoute
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	for _, tier := range []string{"long", "short"} {
+		if result[tier].Stored {
+			t.Errorf("Expected irq/irq not to be stored in tier %s: %+v", tier, result)
+		}
+	}
+	resp, err = http.Get("http://" + apiConfig.Bind + "/lookup?name=foo&metric=cpu/cpu")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	result = nil
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if !result["long"].Stored || result["long"].Target != "127.0.0.1:25989" {
+		t.Errorf("Expected cpu/cpu to be stored on 127.0.0.1:25989 in tier long: %+v", result)
+	}
+}
+
+func TestApiManagesRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Setup filter, with rules saved to a file
+	filterConfig := coco.FilterConfig{RulesFile: filepath.Join(dir, "rules.toml")}
+	rules, err := coco.NewRuleSet(filterConfig)
+	if err != nil {
+		t.Fatalf("Couldn't build rules: %s", err)
+	}
+	raw := make(chan collectd.Packet)
+	filtered := make(chan collectd.Packet, 10)
+	items := make(chan coco.BlacklistItem, 10)
+	go coco.Filter(rules, raw, filtered, items)
+
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind:  "127.0.0.1:26089",
+		Token: "secret",
+	}
+	var tiers []coco.Tier
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig, Filter: filterConfig}, rules, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	request := func(method string, path string, token string, body string) *http.Response {
+		req, _ := http.NewRequest(method, "http://"+apiConfig.Bind+path, strings.NewReader(body))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP %s failed: %s", method, err)
+		}
+		return resp
+	}
+
+	// Requests without the token are rejected
+	if resp := request("GET", "/filter/rules", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without a token, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp := request("GET", "/filter/rules", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d with the wrong token, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Add a rule
+	resp := request("POST", "/filter/rules", "secret", `{"name": "drop-disk", "action": "deny", "plugin": "^disk$"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status %d adding a rule, got %d", http.StatusCreated, resp.StatusCode)
+	}
+	resp = request("POST", "/filter/rules", "secret", `{"name": "bad", "action": "deny", "plugin": "("}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d adding an invalid rule, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Rules that couldn't be removed by name can't be added
+	for _, name := range []string{"a/b", "a b", "..", "a?b"} {
+		resp = request("POST", "/filter/rules", "secret", `{"name": "`+name+`", "action": "deny", "plugin": "^nothing$"}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status %d adding a rule named %s, got %d", http.StatusBadRequest, name, resp.StatusCode)
+		}
+	}
+
+	// Rules with any allowed name can be added and removed
+	resp = request("POST", "/filter/rules", "secret", `{"name": "keep.load_1~x", "action": "allow", "plugin": "^nothing$"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status %d adding a rule, got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp := request("DELETE", "/filter/rules/keep.load_1~x", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d removing a rule, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	// Filter picks up the rule
+	raw <- collectd.Packet{Hostname: "foo", Plugin: "disk", Type: "disk_octets"}
+	raw <- collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"}
+
+	// Breathe a moment so samples work their way through
+	time.Sleep(10 * time.Millisecond)
+	if len(items) != 1 || len(filtered) != 1 {
+		t.Errorf("Expected %d sample blacklisted and %d filtered, got %d and %d", 1, 1, len(items), len(filtered))
+	}
+
+	// List the rules
+	resp = request("GET", "/filter/rules", "secret", "")
+	var list []coco.RuleStatus
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if len(list) != 1 || list[0].Name != "drop-disk" || list[0].Hits != 1 {
+		t.Errorf("Expected drop-disk with %d hit, got %+v", 1, list)
+	}
+
+	// Test a sample against the rules
+	resp = request("POST", "/filter/rules/test", "secret", `{"host": "foo", "plugin": "disk", "type": "disk_octets"}`)
+	var result coco.RuleTestResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if result.Allowed || result.Rule != "drop-disk" {
+		t.Errorf("Expected sample to be denied by drop-disk, got %+v", result)
+	}
+
+	// The rule is saved
+	saved, err := coco.NewRuleSet(filterConfig)
+	if err != nil {
+		t.Fatalf("Couldn't load saved rules: %s", err)
+	}
+	if list := saved.List(); len(list) != 1 || list[0].Name != "drop-disk" {
+		t.Errorf("Expected drop-disk to be saved, got %+v", list)
+	}
+
+	// Remove the rule
+	if resp := request("DELETE", "/filter/rules/drop-disk", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d removing a rule, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	// A rule added with the same name starts counting again
+	request("POST", "/filter/rules", "secret", `{"name": "drop-disk", "action": "deny", "plugin": "^disk$"}`)
+	resp = request("GET", "/filter/rules", "secret", "")
+	list = nil
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if len(list) != 1 || list[0].Hits != 0 {
+		t.Errorf("Expected drop-disk with %d hits, got %+v", 0, list)
+	}
+	request("DELETE", "/filter/rules/drop-disk", "secret", "")
+	if resp := request("DELETE", "/filter/rules/drop-disk", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d removing a missing rule, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	raw <- collectd.Packet{Hostname: "foo", Plugin: "disk", Type: "disk_octets"}
+	time.Sleep(10 * time.Millisecond)
+	if len(filtered) != 2 {
+		t.Errorf("Expected %d samples filtered after removing the rule, got %d", 2, len(filtered))
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	config := coco.RelabelConfig{
+		Rules: []coco.RelabelRuleConfig{
+			{Name: "eth0-to-ens3", Field: "plugin_instance", Pattern: "^eth0$", Replacement: "ens3", Metric: "/interface/"},
+			{Field: "type_instance", Pattern: `^cpu(\d+)$`, Replacement: "core-$1"},
+		},
+	}
+	relabeller, err := coco.NewRelabeller(config)
+	if err != nil {
+		t.Fatalf("Couldn't build relabeller: %s", err)
+	}
+
+	values := []collectd.Value{
+		{Name: "rx", Type: collectd.TypeDerive, TypeName: "derive", Value: 1},
+		{Name: "tx", Type: collectd.TypeDerive, TypeName: "derive", Value: 2},
+	}
+	packet := collectd.Packet{Hostname: "foo", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets", Values: values}
+	applied := relabeller.Relabel(&packet)
+	if packet.PluginInstance != "ens3" {
+		t.Errorf("Expected plugin instance %s, got %s", "ens3", packet.PluginInstance)
+	}
+	if !reflect.DeepEqual(applied, []string{"eth0-to-ens3"}) {
+		t.Errorf("Expected rule eth0-to-ens3 to be applied, got %v", applied)
+	}
+
+	// Rewrites reach what's sent to targets
+	types, err := collectd.TypesDBFile("../types.db")
+	if err != nil {
+		t.Fatalf("Couldn't parse types.db: %s", err)
+	}
+	payload, err := coco.Encode(packet)
+	if err != nil {
+		t.Fatalf("Couldn't encode packet: %s", err)
+	}
+	packets, err := collectd.Packets(payload, types)
+	if err != nil || len(*packets) != 1 {
+		t.Fatalf("Expected %d sample, got %v: %s", 1, packets, err)
+	}
+	if name := coco.MetricName((*packets)[0]); name != "interface/ens3/if_octets" {
+		t.Errorf("Expected %s to be sent, got %s", "interface/ens3/if_octets", name)
+	}
+
+	// Rules only apply to metrics that match
+	packet = collectd.Packet{Hostname: "foo", Plugin: "netlink", PluginInstance: "eth0", Type: "if_octets"}
+	relabeller.Relabel(&packet)
+	if packet.PluginInstance != "eth0" {
+		t.Errorf("Expected plugin instance %s, got %s", "eth0", packet.PluginInstance)
+	}
+
+	// Groups are expanded in replacements
+	packet = collectd.Packet{Hostname: "foo", Plugin: "cpu", Type: "percent", TypeInstance: "cpu3"}
+	applied = relabeller.Relabel(&packet)
+	if packet.TypeInstance != "core-3" || !reflect.DeepEqual(applied, []string{"1"}) {
+		t.Errorf("Expected type instance %s by rule 1, got %s by %v", "core-3", packet.TypeInstance, applied)
+	}
+
+	// Invalid rules are rejected
+	invalid := []coco.RelabelRuleConfig{
+		{Field: "colour", Pattern: "."},
+		// Data source names aren't sent, so they can't be rewritten
+		{Field: "data_source", Pattern: "^rx$", Replacement: "in"},
+		{Field: "host", Pattern: "("},
+		{Field: "host", Pattern: ".", Metric: "("},
+	}
+	for _, rc := range invalid {
+		if _, err := coco.NewRelabeller(coco.RelabelConfig{Rules: []coco.RelabelRuleConfig{rc}}); err == nil {
+			t.Errorf("Expected an error compiling %+v", rc)
+		}
+	}
+}
+
+func TestApiRelabelDryRun(t *testing.T) {
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26090",
+	}
+	relabelConfig := coco.RelabelConfig{
+		Rules: []coco.RelabelRuleConfig{
+			{Name: "eth0-to-ens3", Field: "plugin_instance", Pattern: "^eth0$", Replacement: "ens3"},
+		},
+	}
+	var tiers []coco.Tier
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig, Relabel: relabelConfig}, nil, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	hits := counter("coco.relabel", "eth0-to-ens3")
+
+	// Test
+	resp, err := http.Get("http://" + apiConfig.Bind + "/relabel?host=foo&plugin=interface&plugin_instance=eth0&type=if_octets")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var result coco.RelabelResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if result.Before.Name != "foo/interface/eth0/if_octets" {
+		t.Errorf("Expected name before to be %s, got %s", "foo/interface/eth0/if_octets", result.Before.Name)
+	}
+	if result.After.Name != "foo/interface/ens3/if_octets" {
+		t.Errorf("Expected name after to be %s, got %s", "foo/interface/ens3/if_octets", result.After.Name)
+	}
+	if !reflect.DeepEqual(result.Rules, []string{"eth0-to-ens3"}) {
+		t.Errorf("Expected rule eth0-to-ens3 to be applied, got %v", result.Rules)
+	}
+
+	// Dry runs aren't counted
+	if n := counter("coco.relabel", "eth0-to-ens3") - hits; n != 0 {
+		t.Errorf("Expected coco.relabel.eth0-to-ens3 not to increase, increased by %d", n)
+	}
+}
+
+func TestSeriesLimits(t *testing.T) {
+	// Setup sender, with a tier that lets each host store 5 series, and each
+	// plugin 3 of them
+	tiers := []coco.Tier{
+		{
+			Name:    "limited",
+			Targets: []string{"127.0.0.1:25992"},
+			Limits:  coco.LimitsConfig{MaxSeriesPerHost: 5, MaxSeriesPerPlugin: 3},
+		},
+	}
+	var sendConfig coco.SendConfig
+	sendConfig.FlushInterval.UnmarshalText([]byte("10ms"))
+	filtered := make(chan collectd.Packet)
+	go coco.Send(sendConfig, &tiers, filtered, nil)
+
+	// Setup API
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26091",
+	}
+	blacklisted := coco.NewBlacklisted()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	byHost := counter("coco.limits", "host")
+	byPlugin := counter("coco.limits", "plugin")
+
+	// Test
+	samples := []struct {
+		plugin   string
+		instance string
+	}{
+		{"cpu", "0"}, {"cpu", "1"}, {"cpu", "2"},
+		{"cpu", "3"}, // over the plugin limit
+		{"memory", "free"}, {"memory", "used"},
+		{"memory", "cached"}, // over the host limit
+		{"cpu", "0"},         // existing series are still stored
+	}
+	for _, s := range samples {
+		filtered <- collectd.Packet{
+			Hostname:     "foo",
+			Plugin:       s.plugin,
+			Type:         s.plugin,
+			TypeInstance: s.instance,
+			Values:       []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}},
+		}
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	if n := counter("coco.limits", "host") - byHost; n != 1 {
+		t.Errorf("Expected coco.limits.host to increase by 1, increased by %d", n)
+	}
+	if n := counter("coco.limits", "plugin") - byPlugin; n != 1 {
+		t.Errorf("Expected coco.limits.plugin to increase by 1, increased by %d", n)
+	}
+
+	resp, err := http.Get("http://" + apiConfig.Bind + "/limits")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var limited []coco.LimitedSeries
+	if err := json.NewDecoder(resp.Body).Decode(&limited); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	expected := []coco.LimitedSeries{
+		{Tier: "limited", Host: "foo", Plugin: "cpu", Limit: "plugin", Rejected: 1, LastMetric: "cpu/cpu/3"},
+		{Tier: "limited", Host: "foo", Plugin: "memory", Limit: "host", Rejected: 1, LastMetric: "memory/memory/cached"},
+	}
+	for i := range limited {
+		limited[i].LastSeen = 0
+	}
+	if !reflect.DeepEqual(limited, expected) {
+		t.Errorf("Expected /limits to be %+v, got %+v", expected, limited)
+	}
+}
+
+func TestBlacklistTTL(t *testing.T) {
+	// Negative TTLs fall back to the default
+	config := coco.FilterConfig{}
+	config.BlacklistTTL.UnmarshalText([]byte("-1h"))
+	if ttl := config.TTL(); ttl != 24*time.Hour {
+		t.Errorf("Expected TTL to be %s, got %s", 24*time.Hour, ttl)
+	}
+
+	// Tiny TTLs don't stop entries being recorded
+	config.BlacklistTTL.UnmarshalText([]byte("1ns"))
+	items := make(chan coco.BlacklistItem)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Blacklist(config, items, blacklisted)
+
+	// Test
+	items <- coco.BlacklistItem{Packet: collectd.Packet{Hostname: "foo", Plugin: "irq", Type: "irq"}, Time: time.Now().Unix()}
+
+	// Breathe a moment so the item is recorded
+	time.Sleep(10 * time.Millisecond)
+
+	if len(blacklisted.Entries("foo", "")) != 1 {
+		t.Errorf("Expected entries for foo, got %+v", blacklisted.Entries("", ""))
+	}
+}
+
+func TestBlacklistedEntries(t *testing.T) {
+	// Setup blacklist
+	items := make(chan coco.BlacklistItem)
+	blacklisted := coco.NewBlacklisted()
+	go coco.Blacklist(coco.FilterConfig{}, items, blacklisted)
+
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26092",
+	}
+	var tiers []coco.Tier
+	go coco.Api(coco.Config{Api: apiConfig}, nil, nil, nil, &tiers, blacklisted, nil)
+	poll(t, apiConfig.Bind)
+
+	// Test
+	samples := []coco.BlacklistItem{
+		{Packet: collectd.Packet{Hostname: "foo", Plugin: "irq", Type: "irq", TypeInstance: "7"}, Time: 100, Rule: "blacklist"},
+		{Packet: collectd.Packet{Hostname: "foo", Plugin: "irq", Type: "irq", TypeInstance: "7"}, Time: 200, Rule: "drop-irq"},
+		{Packet: collectd.Packet{Hostname: "foo", Plugin: "users", Type: "users"}, Time: 300, Rule: "blacklist"},
+		{Packet: collectd.Packet{Hostname: "bar", Plugin: "irq", Type: "irq", TypeInstance: "8"}, Time: 400, Rule: "blacklist"},
+	}
+	for _, item := range samples {
+		items <- item
+	}
+
+	// Breathe a moment so the last item is recorded
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://" + apiConfig.Bind + "/blacklisted?host=foo")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var lastSeen map[string]map[string]int64
+	if err := json.NewDecoder(resp.Body).Decode(&lastSeen); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	expectedLastSeen := map[string]map[string]int64{
+		"foo": {"irq/irq/7": 200, "users/users": 300},
+	}
+	if !reflect.DeepEqual(lastSeen, expectedLastSeen) {
+		t.Errorf("Expected /blacklisted to be %+v, got %+v", expectedLastSeen, lastSeen)
+	}
+
+	resp, err = http.Get("http://" + apiConfig.Bind + "/blacklisted/entries?host=foo&plugin=irq")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var entries map[string]map[string]coco.BlacklistEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	expected := map[string]map[string]coco.BlacklistEntry{
+		"foo": {"irq/irq/7": {Plugin: "irq", Rule: "drop-irq", FirstSeen: 100, LastSeen: 200, Hits: 2}},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected /blacklisted/entries to be %+v, got %+v", expected, entries)
+	}
+
+	resp, err = http.Get("http://" + apiConfig.Bind + "/blacklisted/summary")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var summary coco.BlacklistSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if summary.Hosts != 2 || summary.Metrics != 3 || summary.Hits != 4 {
+		t.Errorf("Expected 2 hosts, 3 metrics, and 4 hits, got %+v", summary)
+	}
+	if summary.ByHost["foo"] != (coco.BlacklistTotals{Metrics: 2, Hits: 3}) {
+		t.Errorf("Expected foo to have 2 metrics and 3 hits, got %+v", summary.ByHost["foo"])
+	}
+	if summary.ByRule["blacklist"] != (coco.BlacklistTotals{Metrics: 2, Hits: 2}) {
+		t.Errorf("Expected blacklist rule to have 2 metrics and 2 hits, got %+v", summary.ByRule["blacklist"])
+	}
+
+	// Entries not seen since before the cutoff expire
+	if n := blacklisted.Expire(300); n != 1 {
+		t.Errorf("Expected 1 entry to expire, %d did", n)
+	}
+	if _, ok := blacklisted.Entries("foo", "irq")["foo"]; ok {
+		t.Errorf("Expected foo's irq entries to have expired")
+	}
+	if len(blacklisted.Entries("", "")) != 2 {
+		t.Errorf("Expected entries for 2 hosts to remain, got %+v", blacklisted.Entries("", ""))
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	now := time.Unix(1435639791, 500000000)
+	config := coco.ClockConfig{}
+	config.MaxAge.UnmarshalText([]byte("10m"))
+	config.MaxAhead.UnmarshalText([]byte("1m"))
+	skews := coco.NewSkewTracker()
+
+	stale := counter("coco.clock", "stale")
+	future := counter("coco.clock", "future")
+	dropped := counter("coco.clock", "dropped")
+
+	// Test
+	examples := []struct {
+		packet collectd.Packet
+		kept   bool
+	}{
+		{collectd.Packet{Hostname: "skewed", Time: uint64(now.Unix())}, true},
+		{collectd.Packet{Hostname: "skewed", Time: uint64(now.Unix() - 300)}, true},
+		{collectd.Packet{Hostname: "skewed", Time: uint64(now.Unix() - 3600)}, false},
+		{collectd.Packet{Hostname: "skewed", Time: uint64(now.Unix() + 120)}, false},
+		{collectd.Packet{Hostname: "skewed", TimeHR: uint64(now.Unix()+30) << 30}, true},
+		{collectd.Packet{Hostname: "skewed", TimeHR: uint64(now.Unix()+7200) << 30}, false},
+		// Samples without a timestamp are kept
+		{collectd.Packet{Hostname: "skewed"}, true},
+	}
+	for _, e := range examples {
+		packet := e.packet
+		if kept := coco.CheckClock(config, skews, &packet, now); kept != e.kept {
+			t.Errorf("Expected %+v to be kept: %t, got %t", e.packet, e.kept, kept)
+		}
+		if !reflect.DeepEqual(packet, e.packet) {
+			t.Errorf("Expected %+v not to be restamped, got %+v", e.packet, packet)
+		}
+	}
+
+	if n := counter("coco.clock", "stale") - stale; n != 1 {
+		t.Errorf("Expected coco.clock.stale to increase by 1, increased by %d", n)
+	}
+	if n := counter("coco.clock", "future") - future; n != 2 {
+		t.Errorf("Expected coco.clock.future to increase by 2, increased by %d", n)
+	}
+	if n := counter("coco.clock", "dropped") - dropped; n != 3 {
+		t.Errorf("Expected coco.clock.dropped to increase by 3, increased by %d", n)
+	}
+	if worst := skews.Worst(0); len(worst) != 1 || worst[0].Host != "skewed" || worst[0].Dropped != 3 {
+		t.Errorf("Expected skewed to have 3 samples dropped, got %+v", worst)
+	}
+
+	// Restamp samples outside the window, keeping their resolution
+	config.Restamp = true
+	packet := collectd.Packet{Hostname: "restamped", Time: uint64(now.Unix() - 3600)}
+	if !coco.CheckClock(config, skews, &packet, now) || packet.Time != uint64(now.Unix()) {
+		t.Errorf("Expected sample to be kept with time %d, got %d", now.Unix(), packet.Time)
+	}
+	packet = collectd.Packet{Hostname: "restamped", TimeHR: uint64(now.Unix()+7200) << 30}
+	expected := uint64(now.Unix())<<30 | 1<<29
+	if !coco.CheckClock(config, skews, &packet, now) || packet.TimeHR != expected || packet.Time != 0 {
+		t.Errorf("Expected sample to be kept with high resolution time %d, got %+v", expected, packet)
+	}
+}
+
+func TestApiClockSkew(t *testing.T) {
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26093",
+	}
+	var tiers []coco.Tier
+	skews := coco.NewSkewTracker()
+	go coco.Api(coco.Config{Api: apiConfig}, nil, skews, nil, &tiers, coco.NewBlacklisted(), nil)
+	poll(t, apiConfig.Bind)
+
+	// Test
+	// Whole seconds, so offsets are exact
+	now := time.Unix(time.Now().Unix(), 0)
+	config := coco.ClockConfig{}
+	config.MaxAge.UnmarshalText([]byte("10m"))
+	config.MaxAhead.UnmarshalText([]byte("10m"))
+	offsets := map[string]int64{"slow": -3600, "fast": 86400, "drifting": 900}
+	for host, offset := range offsets {
+		packet := collectd.Packet{Hostname: host, Time: uint64(now.Unix() + offset)}
+		coco.CheckClock(config, skews, &packet, now)
+	}
+
+	resp, err := http.Get("http://" + apiConfig.Bind + "/clock-skew?limit=2")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	var worst []coco.ClockSkew
+	if err := json.NewDecoder(resp.Body).Decode(&worst); err != nil {
+		t.Fatalf("Error when decoding JSON: %s", err)
+	}
+	if len(worst) != 2 {
+		t.Fatalf("Expected 2 hosts, got %+v", worst)
+	}
+	if worst[0].Host != "fast" || worst[1].Host != "slow" {
+		t.Errorf("Expected the worst hosts to be fast and slow, got %s and %s", worst[0].Host, worst[1].Host)
+	}
+	if worst[0].Future != 1 || worst[0].Dropped != 1 || int64(worst[0].WorstOffset) != 86400 {
+		t.Errorf("Expected fast to have 1 future sample dropped, 86400s ahead, got %+v", worst[0])
+	}
+	if worst[1].Stale != 1 || int64(worst[1].WorstOffset) != -3600 {
+		t.Errorf("Expected slow to have 1 stale sample, 3600s behind, got %+v", worst[1])
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	config := coco.DedupConfig{MaxEntries: 2}
+	config.Window.UnmarshalText([]byte("10s"))
+	d := coco.NewDeduper(config)
+	now := time.Unix(1435639791, 0)
+
+	sample := func(instance string, value float64) coco.Frame {
+		return coco.Frame{Packet: collectd.Packet{
+			Hostname:     "foo",
+			Plugin:       "cpu",
+			Type:         "cpu",
+			TypeInstance: instance,
+			Time:         uint64(now.Unix()),
+			Values:       []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: value}},
+		}}
+	}
+
+	// Test
+	examples := []struct {
+		frame     coco.Frame
+		after     time.Duration
+		duplicate bool
+	}{
+		{sample("user", 1), 0, false},
+		{sample("user", 1), time.Second, true},
+		// Same time, but different values
+		{sample("user", 2), time.Second, false},
+		{sample("user", 2), time.Second, true},
+		// Samples without a time are never duplicates
+		{coco.Frame{Packet: collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"}}, time.Second, false},
+		{coco.Frame{Packet: collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"}}, time.Second, false},
+		// Forgotten after the window
+		{sample("user", 2), 20 * time.Second, false},
+		// Forgotten when the cache is full
+		{sample("system", 1), 20 * time.Second, false},
+		{sample("idle", 1), 20 * time.Second, false},
+		{sample("user", 2), 20 * time.Second, false},
+	}
+	for i, e := range examples {
+		if duplicate := d.Duplicate(e.frame, now.Add(e.after)); duplicate != e.duplicate {
+			t.Errorf("Expected sample %d to be duplicate: %t, got %t", i, e.duplicate, duplicate)
+		}
+	}
+}
+
+func TestDeduperDefaults(t *testing.T) {
+	// Negative limits fall back to the defaults
+	config := coco.DedupConfig{MaxEntries: -1}
+	config.Window.UnmarshalText([]byte("-10s"))
+	d := coco.NewDeduper(config)
+	now := time.Unix(1435639791, 0)
+	frame := coco.Frame{Packet: collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+		Time:     uint64(now.Unix()),
+		Values:   []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}},
+	}}
+
+	// Test
+	if d.Duplicate(frame, now) {
+		t.Errorf("Expected first sample not to be a duplicate")
+	}
+	if !d.Duplicate(frame, now.Add(time.Second)) {
+		t.Errorf("Expected second sample to be a duplicate")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	// Setup Dedup
+	filtered := make(chan collectd.Packet)
+	deduped := make(chan collectd.Packet, 10)
+	go coco.Dedup(coco.DedupConfig{Enabled: true}, filtered, deduped)
+
+	total := counter("coco.dedup", "total")
+	duplicates := counter("coco.dedup", "duplicates")
+
+	// Test
+	packet := collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "memory",
+		Type:     "memory",
+		Time:     uint64(time.Now().Unix()),
+		Values:   []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}},
+	}
+	for i := 0; i < 4; i++ {
+		filtered <- packet
+	}
+
+	// Breathe a moment so the last sample is checked
+	time.Sleep(10 * time.Millisecond)
+
+	if len(deduped) != 1 {
+		t.Errorf("Expected %d sample to be forwarded, got %d", 1, len(deduped))
+	}
+	if n := counter("coco.dedup", "total") - total; n != 4 {
+		t.Errorf("Expected coco.dedup.total to increase by 4, increased by %d", n)
+	}
+	if n := counter("coco.dedup", "duplicates") - duplicates; n != 3 {
+		t.Errorf("Expected coco.dedup.duplicates to increase by 3, increased by %d", n)
+	}
+	ratio, ok := expvar.Get("coco.dedup").(*expvar.Map).Get("ratio").(*expvar.Float)
+	if !ok {
+		t.Fatalf("Expected coco.dedup.ratio to be exported")
+	}
+	expected := float64(counter("coco.dedup", "duplicates")) / float64(counter("coco.dedup", "total"))
+	if ratio.Value() != expected {
+		t.Errorf("Expected coco.dedup.ratio to be %f, got %f", expected, ratio.Value())
+	}
+}
+
+func TestListenACLNormalisesHosts(t *testing.T) {
+	// Setup listen, with a host bound to a network we're not on
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25993",
+		Typesdb: "../types.db",
+		HostCIDRs: map[string][]string{
+			"Web01.example.org": []string{"10.0.0.0/8"},
+		},
+	}
+	normaliser, err := coco.NewNormaliser(coco.NormaliseConfig{Lowercase: true, TrimDot: true})
+	if err != nil {
+		t.Fatalf("Couldn't build normaliser: %s", err)
+	}
+	raw := make(chan collectd.Packet, 500)
+	go coco.Listen(listenConfig, normaliser, nil, raw, nil)
+
+	// Breathe a moment so Listen can start
+	time.Sleep(100 * time.Millisecond)
+
+	spoofed := counter("coco.listen", "acl.host.web01.example.org")
+
+	// Test
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+	for _, host := range []string{"web01.example.org", "WEB01.example.org.", "Web01.Example.Org", "foo"} {
+		buf, _ := coco.Encode(collectd.Packet{Hostname: host, Plugin: "load", Type: "load"})
+		conn.Write(buf)
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	if len(raw) != 1 {
+		t.Fatalf("Expected %d packet, got %d\n", 1, len(raw))
+	}
+	// Samples are queued with the hostname they were sent with, for Normalise
+	if p := <-raw; p.Hostname != "foo" {
+		t.Errorf("Expected only samples for foo, got %s", p.Hostname)
+	}
+	if n := counter("coco.listen", "acl.host.web01.example.org") - spoofed; n != 3 {
+		t.Errorf("Expected coco.listen.acl.host.web01.example.org to increase by %d, increased by %d", 3, n)
+	}
+}
+
+func TestListenNormalisesNotifications(t *testing.T) {
+	// Setup listen, with a host bound to a network we're not on
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25995",
+		Typesdb: "../types.db",
+		HostCIDRs: map[string][]string{
+			"Web01.example.org": []string{"10.0.0.0/8"},
+		},
+	}
+	normaliser, err := coco.NewNormaliser(coco.NormaliseConfig{Lowercase: true, TrimDot: true})
+	if err != nil {
+		t.Fatalf("Couldn't build normaliser: %s", err)
+	}
+	raw := make(chan collectd.Packet, 500)
+	notifications := make(chan coco.Notification, 500)
+	go coco.Listen(listenConfig, normaliser, nil, raw, notifications)
+
+	// Breathe a moment so Listen can start
+	time.Sleep(100 * time.Millisecond)
+
+	// Test
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+	for _, host := range []string{"WEB01.example.org.", "DB01.example.org."} {
+		buf, _ := coco.EncodeNotification(coco.Notification{
+			Hostname: host,
+			Plugin:   "disk",
+			Time:     1435639791,
+			Severity: coco.SeverityFailure,
+			Message:  "Disk is full",
+		})
+		conn.Write(buf)
+	}
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	if len(notifications) != 1 {
+		t.Fatalf("Expected %d notification, got %d\n", 1, len(notifications))
+	}
+	// Notifications skip Normalise, so they're queued normalised
+	if n := <-notifications; n.Hostname != "db01.example.org" {
+		t.Errorf("Expected only notifications for db01.example.org, got %s", n.Hostname)
+	}
+}
+
+func TestListenMalformedNotifications(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25997",
+		Typesdb: "../types.db",
+	}
+	raw := make(chan collectd.Packet, 500)
+	notifications := make(chan coco.Notification, 500)
+	go coco.Listen(listenConfig, nil, nil, raw, notifications)
+
+	// Breathe a moment so Listen can start
+	time.Sleep(100 * time.Millisecond)
+
+	// Test
+	// A notification, then a sample with an unknown value type
+	buf, _ := coco.EncodeNotification(coco.Notification{
+		Hostname: "foo",
+		Plugin:   "disk",
+		Time:     1435639791,
+		Severity: coco.SeverityFailure,
+		Message:  "Disk is full",
+	})
+	sample, _ := coco.Encode(collectd.Packet{
+		Hostname: "foo",
+		Plugin:   "load",
+		Type:     "load",
+		Values:   []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}},
+	})
+	sample[len(sample)-9] = 9
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+	conn.Write(append(buf, sample...))
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	// The samples can't be decoded, but the notification is still queued
+	if len(raw) != 0 {
+		t.Errorf("Expected %d samples, got %d\n", 0, len(raw))
+	}
+	if len(notifications) != 1 {
+		t.Fatalf("Expected %d notification, got %d\n", 1, len(notifications))
+	}
+	if n := <-notifications; n.Message != "Disk is full" {
+		t.Errorf("Expected notification %s, got %s", "Disk is full", n.Message)
+	}
+}
+
+func TestRuleSetKeepsHits(t *testing.T) {
+	rules, err := coco.NewRuleSet(coco.FilterConfig{
+		Rules: []coco.RuleConfig{
+			{Action: "deny", Plugin: "^irq$"},
+			{Name: "drop-disk", Action: "deny", Plugin: "^disk$"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't build rules: %s", err)
+	}
+	rules.Rules().Allowed(collectd.Packet{Hostname: "foo", Plugin: "irq", Type: "irq"})
+	rules.Rules().Allowed(collectd.Packet{Hostname: "foo", Plugin: "disk", Type: "disk_octets"})
+	rules.Rules().Allowed(collectd.Packet{Hostname: "foo", Plugin: "disk", Type: "disk_octets"})
+
+	// Insert a rule before the others
+	if err := rules.Add(coco.RuleConfig{Name: "keep-db", Action: "allow", Host: "^db"}, 0); err != nil {
+		t.Fatalf("Couldn't add rule: %s", err)
+	}
+
+	// Rules keep their names and hits
+	expected := map[string]int64{"keep-db": 0, "0": 1, "drop-disk": 2}
+	var names []string
+	for _, rule := range rules.Rules() {
+		names = append(names, rule.Name)
+		if rule.Hits() != expected[rule.Name] {
+			t.Errorf("Expected rule %s to have %d hits, got %d", rule.Name, expected[rule.Name], rule.Hits())
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"keep-db", "0", "drop-disk"}) {
+		t.Errorf("Expected rules keep-db, 0, and drop-disk, got %v", names)
+	}
+	if n := counter("coco.filter.rules", "drop-disk"); n != 2 {
+		t.Errorf("Expected coco.filter.rules.drop-disk to be %d, got %d", 2, n)
+	}
+
+	// Removed rules aren't exported
+	if err := rules.Remove("0"); err != nil {
+		t.Fatalf("Couldn't remove rule: %s", err)
+	}
+	if v := expvar.Get("coco.filter.rules").(*expvar.Map).Get("0"); v != nil {
+		t.Errorf("Expected coco.filter.rules.0 to be removed, got %s", v)
+	}
+}
+
+func TestSkewTrackerKeepsWorstHosts(t *testing.T) {
+	now := time.Unix(1435639791, 0)
+	config := coco.ClockConfig{}
+	config.MaxAhead.UnmarshalText([]byte("1m"))
+	skews := coco.NewSkewTracker()
+
+	// Test
+	for i := 1; i <= 1001; i++ {
+		packet := collectd.Packet{Hostname: "host" + strconv.Itoa(i), Time: uint64(now.Unix() + 60 + int64(i))}
+		coco.CheckClock(config, skews, &packet, now)
+	}
+
+	worst := skews.Worst(0)
+	if len(worst) != 1000 {
+		t.Fatalf("Expected %d hosts to be tracked, got %d", 1000, len(worst))
+	}
+	if worst[0].Host != "host1001" || worst[len(worst)-1].Host != "host2" {
+		t.Errorf("Expected hosts host1001 to host2, got %s to %s", worst[0].Host, worst[len(worst)-1].Host)
+	}
+}
+
+func TestListenCapsUnknownTypes(t *testing.T) {
+	// Setup listen
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25996",
+		Typesdb: "../types.db",
+	}
+	raw := make(chan collectd.Packet, 5000)
+	go coco.Listen(listenConfig, nil, nil, raw, nil)
+
+	// Breathe a moment so Listen can start
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't establish connection to %s: %s", listenConfig.Bind, err)
+	}
+
+	// Test
+	// Dispatch more unknown types than are tracked, then one type from more
+	// hosts than are tracked
+	var samples []collectd.Packet
+	for i := 0; i < 1100; i++ {
+		samples = append(samples, collectd.Packet{Hostname: "foo", Plugin: "custom", Type: "gizmo" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 150; i++ {
+		samples = append(samples, collectd.Packet{Hostname: "host" + strconv.Itoa(i), Plugin: "custom", Type: "sprockets"})
+	}
+	buffer := coco.NewBuffer(coco.MaxPacketSize)
+	for _, sample := range samples {
+		sample.Values = []collectd.Value{{Name: "value", Type: collectd.TypeGauge, Value: 1}}
+		if err := buffer.Append(sample); err == coco.ErrBufferFull {
+			conn.Write(buffer.Bytes())
+			buffer.Reset()
+			buffer.Append(sample)
+		}
+	}
+	conn.Write(buffer.Bytes())
+
+	// Breathe a moment so packets work their way through
+	time.Sleep(100 * time.Millisecond)
+
+	if len(raw) != len(samples) {
+		t.Fatalf("Expected %d packets, got %d\n", len(samples), len(raw))
+	}
+	unknown := coco.UnknownTypes()
+	if len(unknown) != 1000 {
+		t.Errorf("Expected %d unknown types to be tracked, got %d", 1000, len(unknown))
+	}
+	sprockets, ok := unknown["sprockets"]
+	if !ok {
+		t.Fatalf("Expected sprockets to be tracked")
+	}
+	if sprockets.Count != 150 || len(sprockets.Hosts) != 100 {
+		t.Errorf("Expected 150 sprockets from %d hosts, got %d from %d", 100, sprockets.Count, len(sprockets.Hosts))
+	}
+}
@@ -0,0 +1,133 @@
+package coco
+
+import (
+	"expvar"
+	collectd "github.com/kimor79/gollectd"
+	"time"
+)
+
+// dedupKey identifies a sample by its host, metric name, and time.
+type dedupKey struct {
+	host string
+	name string
+	time uint64
+}
+
+// dedupEntry is a sample that has been seen, and when.
+type dedupEntry struct {
+	key dedupKey
+	// The sample's values part, so only exact duplicates are dropped
+	values string
+	seen   time.Time
+}
+
+/*
+Deduper remembers recently seen samples, so duplicates can be dropped.
+
+The cache is bounded by time and size. Samples are forgotten once they're older
+than the window, or when the cache is full, oldest first.
+*/
+type Deduper struct {
+	window     time.Duration
+	maxEntries int
+	entries    map[dedupKey]*dedupEntry
+	// Entries in the order they were seen, oldest first
+	order []*dedupEntry
+}
+
+// NewDeduper sets up an empty cache of seen samples.
+func NewDeduper(config DedupConfig) *Deduper {
+	return &Deduper{
+		window:     config.window(),
+		maxEntries: config.maxEntries(),
+		entries:    make(map[dedupKey]*dedupEntry),
+	}
+}
+
+// forget removes the oldest sample from the cache.
+func (d *Deduper) forget() {
+	oldest := d.order[0]
+	// A later sample with the same key may have replaced it
+	if d.entries[oldest.key] == oldest {
+		delete(d.entries, oldest.key)
+	}
+	d.order[0] = nil
+	d.order = d.order[1:]
+}
+
+/*
+Duplicate checks if a sample has been seen within the window, with the same
+host, metric name, time, and values, and remembers it if it hasn't.
+
+Samples without a time can't be told apart from later samples of the same
+metric, so they're never duplicates.
+*/
+func (d *Deduper) Duplicate(frame Frame, now time.Time) bool {
+	packet := frame.Packet
+	if packet.Time == 0 && packet.TimeHR == 0 {
+		return false
+	}
+	key := dedupKey{host: packet.Hostname, name: MetricName(packet), time: packet.TimeHR}
+	if packet.TimeHR == 0 {
+		key.time = packet.Time << 30
+	}
+
+	values := frame.Values
+	if values == nil {
+		var err error
+		if values, err = appendValues(nil, packet.Values); err != nil {
+			return false
+		}
+	}
+
+	cutoff := now.Add(-d.window)
+	for len(d.order) > 0 && d.order[0].seen.Before(cutoff) {
+		d.forget()
+	}
+	if entry, ok := d.entries[key]; ok && entry.values == string(values) {
+		return true
+	}
+
+	for len(d.order) >= d.maxEntries {
+		d.forget()
+	}
+	entry := &dedupEntry{key: key, values: string(values), seen: now}
+	d.entries[key] = entry
+	d.order = append(d.order, entry)
+	return false
+}
+
+// countDedup counts a sample checked for duplicates, and updates the ratio of
+// duplicates to samples checked.
+func countDedup(duplicate bool) {
+	dedupCounts.Add("total", 1)
+	if duplicate {
+		dedupCounts.Add("duplicates", 1)
+	}
+	total := dedupCounts.Get("total").(*expvar.Int).Value()
+	duplicates := dedupCounts.Get("duplicates").(*expvar.Int).Value()
+	dedupRatio.Set(float64(duplicates) / float64(total))
+}
+
+// initDedupCounts initialises the dedup counts.
+func initDedupCounts() {
+	dedupCounts.Add("total", 0)
+	dedupCounts.Add("duplicates", 0)
+	dedupCounts.Set("ratio", dedupRatio)
+}
+
+// Dedup takes samples from Filter, drops the duplicates, and queues the rest
+// for Send.
+func Dedup(config DedupConfig, in chan collectd.Packet, out chan collectd.Packet) {
+	initDedupCounts()
+
+	d := NewDeduper(config)
+	for {
+		packet := <-in
+		duplicate := d.Duplicate(Frame{Packet: packet}, time.Now())
+		countDedup(duplicate)
+		if !duplicate {
+			out <- packet
+		}
+	}
+}
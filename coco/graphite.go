@@ -0,0 +1,271 @@
+package coco
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultGraphiteTemplate maps Graphite paths to samples when no templates
+// are configured.
+const DefaultGraphiteTemplate = "host.plugin.plugin_instance.type.type_instance"
+
+var (
+	ErrGraphiteLine     = errors.New("graphite line is not 'path value timestamp'")
+	ErrGraphiteTemplate = errors.New("graphite path does not match any template")
+)
+
+// graphiteFields are the sample fields a template can map path nodes to.
+var graphiteFields = map[string]bool{
+	"":                true,
+	"host":            true,
+	"plugin":          true,
+	"plugin_instance": true,
+	"type":            true,
+	"type_instance":   true,
+}
+
+/*
+GraphiteTemplate maps the nodes of a dotted Graphite path to the fields of a
+sample. A template like
+
+	host.plugin.plugin_instance.type.type_instance
+
+maps each node of a five node path to a field, in order. An empty field skips
+a node, a field used more than once joins its nodes with dots, and a "*" on
+the last field absorbs any remaining nodes:
+
+	servers.*.cpu .host.plugin.type_instance*
+
+The optional filter before the template restricts it to paths starting with
+matching nodes, where "*" matches any node.
+*/
+type GraphiteTemplate struct {
+	filter []string
+	fields []string
+	greedy bool
+}
+
+// ParseGraphiteTemplate compiles a template, with an optional filter.
+func ParseGraphiteTemplate(spec string) (*GraphiteTemplate, error) {
+	t := &GraphiteTemplate{}
+	parts := strings.Fields(spec)
+	switch len(parts) {
+	case 1:
+	case 2:
+		t.filter = strings.Split(parts[0], ".")
+	default:
+		return nil, fmt.Errorf("graphite template '%s' should be '[filter] template'", spec)
+	}
+
+	t.fields = strings.Split(parts[len(parts)-1], ".")
+	last := t.fields[len(t.fields)-1]
+	if strings.HasSuffix(last, "*") {
+		t.greedy = true
+		t.fields[len(t.fields)-1] = strings.TrimSuffix(last, "*")
+	}
+
+	var host bool
+	for _, f := range t.fields {
+		if !graphiteFields[f] {
+			return nil, fmt.Errorf("graphite template '%s' has unknown field '%s'", spec, f)
+		}
+		host = host || f == "host"
+	}
+	if !host {
+		return nil, fmt.Errorf("graphite template '%s' has no host field", spec)
+	}
+	return t, nil
+}
+
+// Match checks if the template can be applied to a path's nodes.
+func (t *GraphiteTemplate) Match(nodes []string) bool {
+	if len(t.filter) > len(nodes) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != nodes[i] {
+			return false
+		}
+	}
+	if t.greedy {
+		return len(nodes) >= len(t.fields)
+	}
+	return len(nodes) == len(t.fields)
+}
+
+// Apply maps a path's nodes to the fields of a sample.
+func (t *GraphiteTemplate) Apply(nodes []string) collectd.Packet {
+	values := map[string][]string{}
+	for i, f := range t.fields {
+		if t.greedy && i == len(t.fields)-1 {
+			values[f] = append(values[f], nodes[i:]...)
+		} else {
+			values[f] = append(values[f], nodes[i])
+		}
+	}
+
+	packet := collectd.Packet{
+		Hostname:       strings.Join(values["host"], "."),
+		Plugin:         strings.Join(values["plugin"], "."),
+		PluginInstance: strings.Join(values["plugin_instance"], "."),
+		Type:           strings.Join(values["type"], "."),
+		TypeInstance:   strings.Join(values["type_instance"], "."),
+	}
+	if len(packet.Type) == 0 {
+		packet.Type = "gauge"
+	}
+	return packet
+}
+
+/*
+ParseGraphite turns a Graphite plaintext line into a sample, with the first
+template that matches its path.
+
+Graphite only has one kind of value, so the sample has a single gauge value.
+A timestamp of -1 or N is taken to be the current time.
+*/
+func ParseGraphite(line string, templates []*GraphiteTemplate) (collectd.Packet, error) {
+	parts := strings.Fields(line)
+	if len(parts) != 3 {
+		return collectd.Packet{}, ErrGraphiteLine
+	}
+	value, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return collectd.Packet{}, ErrGraphiteLine
+	}
+	timestamp := time.Now().Unix()
+	if parts[2] != "-1" && parts[2] != "N" {
+		t, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || t < 0 {
+			return collectd.Packet{}, ErrGraphiteLine
+		}
+		timestamp = int64(t)
+	}
+
+	nodes := strings.Split(parts[0], ".")
+	for _, t := range templates {
+		if !t.Match(nodes) {
+			continue
+		}
+		packet := t.Apply(nodes)
+		if len(packet.Hostname) == 0 || len(packet.Plugin) == 0 {
+			continue
+		}
+		packet.Time = uint64(timestamp)
+		packet.Values = []collectd.Value{
+			{Name: "value", Type: collectd.TypeGauge, TypeName: "gauge", Value: value},
+		}
+		return packet, nil
+	}
+	return collectd.Packet{}, ErrGraphiteTemplate
+}
+
+// graphiteTemplates compiles the configured templates, or the default.
+func graphiteTemplates(config GraphiteConfig) ([]*GraphiteTemplate, error) {
+	specs := config.Templates
+	if len(specs) == 0 {
+		specs = []string{DefaultGraphiteTemplate}
+	}
+	var templates []*GraphiteTemplate
+	for _, spec := range specs {
+		t, err := ParseGraphiteTemplate(spec)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+/*
+ListenGraphite takes Graphite plaintext lines over TCP and UDP, and turns them
+into samples with the configured templates.
+*/
+func ListenGraphite(config GraphiteConfig, c chan collectd.Packet) {
+	// Initialise the error counts
+	errorCounts.Add("listen.graphite.receive", 0)
+	errorCounts.Add("listen.graphite.parse", 0)
+	errorCounts.Add("listen.graphite.template", 0)
+
+	templates, err := graphiteTemplates(config)
+	if err != nil {
+		log.Fatalln("[fatal] ListenGraphite:", err)
+	}
+
+	ln, err := net.Listen("tcp", config.Bind)
+	if err != nil {
+		log.Fatalln("[fatal] ListenGraphite: failed to listen", err)
+	}
+	addr, err := net.ResolveUDPAddr("udp", config.Bind)
+	if err != nil {
+		log.Fatalln("[fatal] ListenGraphite: failed to resolve address", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalln("[fatal] ListenGraphite: failed to listen", err)
+	}
+	log.Printf("[info] ListenGraphite: listening on %s\n", config.Bind)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Println("[error] ListenGraphite: Failed to accept connection", err)
+				errorCounts.Add("listen.graphite.receive", 1)
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				receiveGraphite(conn, templates, c)
+			}()
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			log.Println("[error] ListenGraphite: Failed to receive packet", err)
+			errorCounts.Add("listen.graphite.receive", 1)
+			continue
+		}
+		receiveGraphite(bytes.NewReader(buf[:n]), templates, c)
+	}
+}
+
+// receiveGraphite reads lines until r is exhausted, and queues the samples
+// for Filter.
+func receiveGraphite(r io.Reader, templates []*GraphiteTemplate, c chan collectd.Packet) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		listenCounts.Add("graphite.raw", 1)
+
+		packet, err := ParseGraphite(line, templates)
+		switch err {
+		case nil:
+			listenCounts.Add("decoded", 1)
+			c <- packet
+		case ErrGraphiteTemplate:
+			errorCounts.Add("listen.graphite.template", 1)
+		default:
+			errorCounts.Add("listen.graphite.parse", 1)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("[error] ListenGraphite: Failed to read lines", err)
+		errorCounts.Add("listen.graphite.receive", 1)
+	}
+}
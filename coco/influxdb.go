@@ -0,0 +1,275 @@
+package coco
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-martini/martini"
+	collectd "github.com/kimor79/gollectd"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInfluxLine = errors.New("influxdb line is not 'measurement,tags fields timestamp'")
+	ErrInfluxHost = errors.New("influxdb line has no host tag")
+)
+
+// influxPrecisions maps the precision parameter of a write to the duration
+// of a timestamp unit.
+var influxPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// splitInflux splits s on sep, skipping escaped characters, and optionally
+// separators inside double quoted strings.
+func splitInflux(s string, sep byte, quotes bool) []string {
+	var parts []string
+	var quoted bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the backslashes from escaped commas, equals signs,
+// spaces, and double quotes.
+var unescapeInflux = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`).Replace
+
+/*
+ParseInflux turns an InfluxDB line protocol line into samples, one for each
+numeric or boolean field.
+
+The measurement becomes the plugin, the value of the host tag becomes the
+host, the values of any other tags (sorted by key and joined with dashes)
+become the plugin instance, and the field key becomes the type instance. Every
+sample has the gauge type, and booleans are sent as 1 or 0. String fields are
+skipped.
+*/
+func ParseInflux(line string, hostTag string, precision time.Duration) ([]collectd.Packet, error) {
+	sections := splitInflux(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, ErrInfluxLine
+	}
+
+	// measurement,tag=value,tag=value
+	key := splitInflux(sections[0], ',', false)
+	measurement := unescapeInflux(key[0])
+	if len(measurement) == 0 {
+		return nil, ErrInfluxLine
+	}
+	var host string
+	tags := map[string]string{}
+	var names []string
+	for _, tag := range key[1:] {
+		kv := splitInflux(tag, '=', false)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, ErrInfluxLine
+		}
+		k, v := unescapeInflux(kv[0]), unescapeInflux(kv[1])
+		if k == hostTag {
+			host = v
+			continue
+		}
+		tags[k] = v
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var instance []string
+	for _, k := range names {
+		instance = append(instance, tags[k])
+	}
+
+	timestamp := time.Now()
+	if len(sections) == 3 {
+		n, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, ErrInfluxLine
+		}
+		timestamp = time.Unix(0, n*int64(precision))
+	}
+
+	// field=value,field=value
+	var packets []collectd.Packet
+	for _, field := range splitInflux(sections[1], ',', true) {
+		kv := splitInflux(field, '=', true)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, ErrInfluxLine
+		}
+		var value float64
+		switch v := kv[1]; {
+		case strings.HasPrefix(v, `"`):
+			continue
+		case v == "t" || v == "T" || v == "true" || v == "True" || v == "TRUE":
+			value = 1
+		case v == "f" || v == "F" || v == "false" || v == "False" || v == "FALSE":
+			value = 0
+		default:
+			var err error
+			value, err = strconv.ParseFloat(strings.TrimRight(v, "iu"), 64)
+			if err != nil {
+				return nil, ErrInfluxLine
+			}
+		}
+		packets = append(packets, collectd.Packet{
+			Hostname:       host,
+			Plugin:         measurement,
+			PluginInstance: strings.Join(instance, "-"),
+			Type:           "gauge",
+			TypeInstance:   unescapeInflux(kv[0]),
+			Time:           uint64(timestamp.Unix()),
+			Values: []collectd.Value{
+				{Name: "value", Type: collectd.TypeGauge, TypeName: "gauge", Value: value},
+			},
+		})
+	}
+
+	if len(host) == 0 {
+		return nil, ErrInfluxHost
+	}
+	return packets, nil
+}
+
+// receiveInflux reads lines until r is exhausted, queues the samples for
+// Filter, and returns the first error.
+func receiveInflux(r io.Reader, config InfluxDBConfig, precision time.Duration, c chan collectd.Packet) error {
+	var first error
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		listenCounts.Add("influxdb.raw", 1)
+
+		packets, err := ParseInflux(line, config.hostTag(), precision)
+		if err != nil {
+			switch err {
+			case ErrInfluxHost:
+				errorCounts.Add("listen.influxdb.host", 1)
+			default:
+				errorCounts.Add("listen.influxdb.parse", 1)
+			}
+			if first == nil {
+				first = fmt.Errorf("%s: %s", err, line)
+			}
+			continue
+		}
+		for _, p := range packets {
+			listenCounts.Add("decoded", 1)
+			c <- p
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errorCounts.Add("listen.influxdb.receive", 1)
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// InfluxWrite handles writes to the /write endpoint, like InfluxDB does.
+func InfluxWrite(w http.ResponseWriter, req *http.Request, config InfluxDBConfig, c chan collectd.Packet) {
+	respond := func(code int, err error) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		data, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.Write(data)
+	}
+
+	precision, ok := influxPrecisions[req.URL.Query().Get("precision")]
+	if !ok {
+		respond(http.StatusBadRequest, fmt.Errorf("unknown precision '%s'", req.URL.Query().Get("precision")))
+		return
+	}
+
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			respond(http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	if err := receiveInflux(body, config, precision, c); err != nil {
+		respond(http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+ListenInfluxDB takes InfluxDB line protocol writes over HTTP at /write, and
+over UDP, and turns them into samples.
+*/
+func ListenInfluxDB(config InfluxDBConfig, c chan collectd.Packet) {
+	// Initialise the error counts
+	errorCounts.Add("listen.influxdb.receive", 0)
+	errorCounts.Add("listen.influxdb.parse", 0)
+	errorCounts.Add("listen.influxdb.host", 0)
+
+	addr, err := net.ResolveUDPAddr("udp", config.Bind)
+	if err != nil {
+		log.Fatalln("[fatal] ListenInfluxDB: failed to resolve address", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalln("[fatal] ListenInfluxDB: failed to listen", err)
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				log.Println("[error] ListenInfluxDB: Failed to receive packet", err)
+				errorCounts.Add("listen.influxdb.receive", 1)
+				continue
+			}
+			receiveInflux(bytes.NewReader(buf[:n]), config, time.Nanosecond, c)
+		}
+	}()
+
+	// Like martini.Classic, without logging every write
+	r := martini.NewRouter()
+	m := martini.New()
+	m.Use(martini.Recovery())
+	m.MapTo(r, (*martini.Routes)(nil))
+	m.Action(r.Handle)
+	r.Post("/write", func(w http.ResponseWriter, req *http.Request) {
+		InfluxWrite(w, req, config, c)
+	})
+	r.Get("/ping", func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	log.Printf("[info] ListenInfluxDB: listening on %s\n", config.Bind)
+	log.Fatalf("[fatal] ListenInfluxDB: HTTP handler crashed: %s", http.ListenAndServe(config.Bind, m))
+}
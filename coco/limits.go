@@ -0,0 +1,115 @@
+package coco
+
+import (
+	collectd "github.com/kimor79/gollectd"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits a host's new series can be rejected by.
+const (
+	LimitHost   = "host"
+	LimitPlugin = "plugin"
+)
+
+// LimitedSeries tracks the new series rejected for a host's plugin in a tier,
+// because the host or plugin has too many series.
+type LimitedSeries struct {
+	Tier   string `json:"tier"`
+	Host   string `json:"host"`
+	Plugin string `json:"plugin"`
+	// Which limit the series were rejected by, host or plugin
+	Limit    string `json:"limit"`
+	Rejected int64  `json:"rejected"`
+	LastSeen int64  `json:"last_seen"`
+	// The most recently rejected series
+	LastMetric string `json:"last_metric"`
+}
+
+// seriesKey identifies a host's plugin in a tier.
+type seriesKey struct {
+	tier   string
+	host   string
+	plugin string
+}
+
+// maxLimitedSeries is the most hosts' plugins listed at /limits.
+const maxLimitedSeries = 1000
+
+var limited = struct {
+	sync.Mutex
+	m map[seriesKey]*LimitedSeries
+}{m: map[seriesKey]*LimitedSeries{}}
+
+// Limited returns the hosts and plugins that have had new series rejected,
+// sorted by host, plugin, and tier.
+func Limited() []LimitedSeries {
+	limited.Lock()
+	defer limited.Unlock()
+	var l []LimitedSeries
+	for _, s := range limited.m {
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Host != l[j].Host {
+			return l[i].Host < l[j].Host
+		}
+		if l[i].Plugin != l[j].Plugin {
+			return l[i].Plugin < l[j].Plugin
+		}
+		return l[i].Tier < l[j].Tier
+	})
+	return l
+}
+
+// rejectSeries counts a new series rejected by a limit, and keeps track of
+// the host and plugin it came from.
+func rejectSeries(tier string, packet collectd.Packet, limit string) {
+	limitCounts.Add(limit, 1)
+
+	key := seriesKey{tier: tier, host: packet.Hostname, plugin: packet.Plugin}
+	limited.Lock()
+	defer limited.Unlock()
+	s, ok := limited.m[key]
+	if !ok {
+		if len(limited.m) >= maxLimitedSeries {
+			forgetLimited()
+		}
+		s = &LimitedSeries{Tier: tier, Host: packet.Hostname, Plugin: packet.Plugin}
+		limited.m[key] = s
+	}
+	s.Limit = limit
+	s.Rejected++
+	s.LastSeen = time.Now().Unix()
+	s.LastMetric = MetricName(packet)
+}
+
+// forgetLimited stops listing the host's plugin that least recently had a
+// series rejected, to make room for another. The limited lock must be held.
+func forgetLimited() {
+	var oldest *LimitedSeries
+	var oldestKey seriesKey
+	for key, s := range limited.m {
+		if oldest == nil || s.LastSeen < oldest.LastSeen {
+			oldest, oldestKey = s, key
+		}
+	}
+	delete(limited.m, oldestKey)
+}
+
+// admit checks if a new series for a host can be stored on a target, or if
+// the host or its plugin already has as many series as it's allowed.
+func (t *Tier) admit(target string, packet collectd.Packet) bool {
+	if t.Limits.MaxSeriesPerHost > 0 && len(t.Mappings[target][packet.Hostname]) >= t.Limits.MaxSeriesPerHost {
+		rejectSeries(t.Name, packet, LimitHost)
+		return false
+	}
+	key := seriesKey{tier: t.Name, host: packet.Hostname, plugin: packet.Plugin}
+	if t.Limits.MaxSeriesPerPlugin > 0 && t.pluginSeries[key] >= t.Limits.MaxSeriesPerPlugin {
+		rejectSeries(t.Name, packet, LimitPlugin)
+		return false
+	}
+	t.pluginSeries[key]++
+	return true
+}
@@ -0,0 +1,82 @@
+package coco
+
+import (
+	"encoding/hex"
+	collectd "github.com/kimor79/gollectd"
+	"sync"
+	"time"
+)
+
+// maxMalformed is how many malformed datagrams are kept for the Api.
+const maxMalformed = 100
+
+// Malformed is a datagram that couldn't be decoded, and where it came from.
+type Malformed struct {
+	Source  string `json:"source"`
+	Time    int64  `json:"time"`
+	Error   string `json:"error"`
+	Payload string `json:"payload"`
+}
+
+var malformed = struct {
+	sync.Mutex
+	l []Malformed
+}{}
+
+// RecentMalformed returns the datagrams most recently found to be malformed,
+// oldest first.
+func RecentMalformed() []Malformed {
+	malformed.Lock()
+	defer malformed.Unlock()
+	return append([]Malformed{}, malformed.l...)
+}
+
+// captureMalformed counts a datagram that couldn't be decoded by the cause,
+// and keeps a copy of it so the client sending it can be found.
+func captureMalformed(source string, buf []byte, err error) {
+	switch err {
+	case collectd.ErrorInvalid:
+		errorCounts.Add("listen.decode.invalid", 1)
+	case collectd.ErrorUnknownType:
+		errorCounts.Add("listen.decode.unknown_type", 1)
+	case collectd.ErrorUnsupported:
+		errorCounts.Add("listen.decode.unsupported", 1)
+	case collectd.ErrorUnknownDataType:
+		errorCounts.Add("listen.decode.unknown_data_type", 1)
+	default:
+		errorCounts.Add("listen.decode.other", 1)
+	}
+	keepMalformed(source, buf, err)
+}
+
+// keepMalformed keeps a hex encoded copy of a datagram that couldn't be
+// decoded.
+func keepMalformed(source string, buf []byte, err error) {
+	m := Malformed{
+		Source:  source,
+		Time:    time.Now().Unix(),
+		Error:   err.Error(),
+		Payload: hex.EncodeToString(buf),
+	}
+	malformed.Lock()
+	malformed.l = append(malformed.l, m)
+	if len(malformed.l) > maxMalformed {
+		malformed.l = malformed.l[1:]
+	}
+	malformed.Unlock()
+}
+
+// decode decodes a collectd packet into samples. collectd.Packets panics on
+// some truncated parts, so those are recovered and reported as invalid.
+func decode(buf []byte, types collectd.Types) (packets []collectd.Packet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			packets, err = nil, collectd.ErrorInvalid
+		}
+	}()
+	p, err := collectd.Packets(buf, types)
+	if err != nil {
+		return nil, err
+	}
+	return *p, nil
+}
@@ -0,0 +1,86 @@
+package coco
+
+import (
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Normaliser rewrites hostnames so that a host reporting under several
+// variants of its name is hashed and stored under one.
+type Normaliser struct {
+	config   NormaliseConfig
+	rewrites []*regexp.Regexp
+}
+
+// NewNormaliser compiles the rewrites in a normalise config.
+func NewNormaliser(config NormaliseConfig) (*Normaliser, error) {
+	n := &Normaliser{config: config}
+	for _, r := range config.Rewrite {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern '%s': %s", r.Pattern, err)
+		}
+		n.rewrites = append(n.rewrites, re)
+	}
+	return n, nil
+}
+
+/*
+Hostname normalises a hostname. The steps are applied in order:
+
+ 1. Trim a trailing dot
+ 2. Lowercase
+ 3. Strip the first matching domain
+ 4. Append a domain, if the hostname doesn't have one
+ 5. Apply each rewrite, in order
+
+A nil Normaliser leaves hostnames as they are.
+*/
+func (n *Normaliser) Hostname(host string) string {
+	if n == nil {
+		return host
+	}
+	if n.config.TrimDot {
+		host = strings.TrimSuffix(host, ".")
+	}
+	if n.config.Lowercase {
+		host = strings.ToLower(host)
+	}
+	for _, domain := range n.config.StripDomain {
+		suffix := "." + strings.TrimPrefix(domain, ".")
+		if strings.HasSuffix(host, suffix) {
+			host = strings.TrimSuffix(host, suffix)
+			break
+		}
+	}
+	if len(n.config.AppendDomain) > 0 && !strings.Contains(host, ".") {
+		host = host + "." + strings.TrimPrefix(n.config.AppendDomain, ".")
+	}
+	for i, re := range n.rewrites {
+		host = re.ReplaceAllString(host, n.config.Rewrite[i].Replacement)
+	}
+	return host
+}
+
+// Normalise takes samples from Listen, normalises their hostnames, and queues
+// them for Filter.
+func Normalise(config NormaliseConfig, raw chan collectd.Packet, normalised chan collectd.Packet) {
+	n, err := NewNormaliser(config)
+	if err != nil {
+		log.Fatalln("[fatal] Normalise:", err)
+	}
+
+	for {
+		packet := <-raw
+		host := n.Hostname(packet.Hostname)
+		if host != packet.Hostname {
+			normaliseCounts.Add("rewritten", 1)
+			packet.Hostname = host
+		}
+		normaliseCounts.Add("total", 1)
+		normalised <- packet
+	}
+}
@@ -0,0 +1,202 @@
+package coco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Notification severities, as per collectd's plugin.h.
+const (
+	SeverityFailure = 1
+	SeverityWarning = 2
+	SeverityOkay    = 4
+)
+
+// Notification is a collectd notification, like those sent by the threshold
+// plugin when a value crosses a threshold.
+type Notification struct {
+	Hostname       string `json:"host"`
+	Plugin         string `json:"plugin"`
+	PluginInstance string `json:"plugin_instance"`
+	Type           string `json:"type"`
+	TypeInstance   string `json:"type_instance"`
+	Time           uint64 `json:"time"`
+	Severity       int    `json:"severity"`
+	Message        string `json:"message"`
+}
+
+/*
+Notifications finds the notifications in a collectd packet.
+
+Like collectd's network plugin, a notification is complete when its message
+part is received, and takes the host, plugin, type, and time parts that came
+before it. Notifications without a valid severity are skipped, and those
+without a time are given the current time.
+*/
+func Notifications(buf []byte) ([]Notification, error) {
+	var notifications []Notification
+	var n Notification
+
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, collectd.ErrorInvalid
+		}
+		kind := binary.BigEndian.Uint16(buf[0:2])
+		length := int(binary.BigEndian.Uint16(buf[2:4]))
+		if length < 5 || length > len(buf) {
+			return nil, collectd.ErrorInvalid
+		}
+		part := buf[4:length]
+
+		switch kind {
+		case collectd.ParseHost:
+			n.Hostname = string(part[:len(part)-1])
+		case collectd.ParsePlugin:
+			n.Plugin = string(part[:len(part)-1])
+		case collectd.ParsePluginInstance:
+			n.PluginInstance = string(part[:len(part)-1])
+		case collectd.ParseType:
+			n.Type = string(part[:len(part)-1])
+		case collectd.ParseTypeInstance:
+			n.TypeInstance = string(part[:len(part)-1])
+		case collectd.ParseTime, collectd.ParseTimeHR, collectd.ParseSeverity:
+			if len(part) != 8 {
+				return nil, collectd.ErrorInvalid
+			}
+			v := binary.BigEndian.Uint64(part)
+			switch kind {
+			case collectd.ParseTime:
+				n.Time = v
+			case collectd.ParseTimeHR:
+				// High resolution times are in units of 2^-30 seconds
+				n.Time = v >> 30
+			case collectd.ParseSeverity:
+				n.Severity = int(v)
+			}
+		case collectd.ParseMessage:
+			n.Message = string(bytes.TrimRight(part, "\x00"))
+			switch n.Severity {
+			case SeverityFailure, SeverityWarning, SeverityOkay:
+				notification := n
+				if notification.Time == 0 {
+					notification.Time = uint64(time.Now().Unix())
+				}
+				notifications = append(notifications, notification)
+			}
+		}
+
+		buf = buf[length:]
+	}
+
+	return notifications, nil
+}
+
+// EncodeNotification encodes a Notification into the collectd wire protocol
+// format.
+func EncodeNotification(n Notification) ([]byte, error) {
+	buf, err := encodeMetadata(collectd.Packet{}, collectd.Packet{
+		Hostname:       n.Hostname,
+		Time:           n.Time,
+		Plugin:         n.Plugin,
+		PluginInstance: n.PluginInstance,
+		Type:           n.Type,
+		TypeInstance:   n.TypeInstance,
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf = appendNumber(buf, collectd.ParseSeverity, uint64(n.Severity))
+	return appendString(buf, collectd.ParseMessage, n.Message)
+}
+
+// maxRecentNotifications is how many notifications are kept for the Api.
+const maxRecentNotifications = 100
+
+var recentNotifications = struct {
+	sync.Mutex
+	l []Notification
+}{}
+
+// RecentNotifications returns the notifications most recently received,
+// oldest first.
+func RecentNotifications() []Notification {
+	recentNotifications.Lock()
+	defer recentNotifications.Unlock()
+	return append([]Notification{}, recentNotifications.l...)
+}
+
+// Notify dispatches a notification to the target that owns the
+// notification's host, like a sample. The host should already be normalised,
+// so it's routed to the same target as the host's samples.
+func (t *Tier) Notify(n Notification) {
+	target, err := t.Lookup(n.Hostname)
+	if err != nil {
+		log.Fatalf("[fatal] Send: couldn't lookup target: %s\n", err)
+	}
+	if t.Connections[target] == nil {
+		errorCounts.Add("send.disconnected", 1)
+		return
+	}
+
+	buf, err := EncodeNotification(n)
+	if err != nil {
+		errorCounts.Add("send.encode", 1)
+		return
+	}
+	payload, err := t.Seal(buf)
+	if err != nil {
+		errorCounts.Add("send.seal", 1)
+		return
+	}
+	if _, err := t.Connections[target].Write(payload); err != nil {
+		errorCounts.Add("send.write", 1)
+		return
+	}
+	notificationCounts.Add(target, 1)
+}
+
+// notify keeps a notification for the Api, dispatches it to every tier, and
+// posts it to the webhook, if there is one.
+func notify(config SendConfig, tiers *[]Tier, n Notification) {
+	notificationCounts.Add("total", 1)
+
+	recentNotifications.Lock()
+	recentNotifications.l = append(recentNotifications.l, n)
+	if len(recentNotifications.l) > maxRecentNotifications {
+		recentNotifications.l = recentNotifications.l[1:]
+	}
+	recentNotifications.Unlock()
+
+	for _, tier := range *tiers {
+		tier.Notify(n)
+	}
+
+	if len(config.NotificationWebhook) > 0 {
+		go postNotification(config.NotificationWebhook, n)
+	}
+}
+
+// webhookClient posts notifications to the webhook.
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// postNotification posts a notification as JSON to a webhook.
+func postNotification(url string, n Notification) {
+	data, _ := json.Marshal(n)
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println("[error] Send: Failed to post notification to webhook", err)
+		errorCounts.Add("send.webhook", 1)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[error] Send: Webhook responded to notification with %s\n", resp.Status)
+		errorCounts.Add("send.webhook", 1)
+	}
+}
@@ -0,0 +1,218 @@
+package coco
+
+import (
+	"encoding/binary"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+	"net"
+	"time"
+)
+
+// Frame is a single sample sliced out of a collectd packet. Values holds the
+// sample's values part exactly as it was received, so the sample can be
+// forwarded without decoding its values.
+type Frame struct {
+	Packet collectd.Packet
+	Values []byte
+}
+
+/*
+Split breaks a collectd packet into Frames, one per value list.
+
+Split only parses the host, time, interval, plugin, and type parts needed to
+hash and filter each sample. Values parts are sliced out of buf rather than
+decoded, so types.db isn't needed, and values for types that aren't in
+types.db survive the trip.
+
+The Frames reference buf, so buf must not be modified until they have been
+dispatched.
+*/
+func Split(buf []byte) ([]Frame, error) {
+	var frames []Frame
+	var packet collectd.Packet
+
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, collectd.ErrorInvalid
+		}
+		kind := binary.BigEndian.Uint16(buf[0:2])
+		length := int(binary.BigEndian.Uint16(buf[2:4]))
+		if length < 5 || length > len(buf) {
+			return nil, collectd.ErrorInvalid
+		}
+		part := buf[4:length]
+
+		switch kind {
+		case collectd.ParseHost:
+			packet.Hostname = string(part[:len(part)-1])
+		case collectd.ParsePlugin:
+			packet.Plugin = string(part[:len(part)-1])
+		case collectd.ParsePluginInstance:
+			packet.PluginInstance = string(part[:len(part)-1])
+		case collectd.ParseType:
+			packet.Type = string(part[:len(part)-1])
+		case collectd.ParseTypeInstance:
+			packet.TypeInstance = string(part[:len(part)-1])
+		case collectd.ParseTime, collectd.ParseTimeHR, collectd.ParseInterval, collectd.ParseIntervalHR:
+			if len(part) != 8 {
+				return nil, collectd.ErrorInvalid
+			}
+			n := binary.BigEndian.Uint64(part)
+			switch kind {
+			case collectd.ParseTime:
+				packet.Time = n
+			case collectd.ParseTimeHR:
+				packet.TimeHR = n
+			case collectd.ParseInterval:
+				packet.Interval = n
+			case collectd.ParseIntervalHR:
+				packet.IntervalHR = n
+			}
+		case collectd.ParseValues:
+			// number of values(2) + a type(1) and value(8) for each value
+			if len(part) < 2 || len(part) != 2+int(binary.BigEndian.Uint16(part[0:2]))*9 {
+				return nil, collectd.ErrorInvalid
+			}
+			frames = append(frames, Frame{Packet: packet, Values: buf[:length]})
+		case collectd.ParseSignature, collectd.ParseEncryption:
+			return nil, collectd.ErrorUnsupported
+		default:
+			// Ignore unknown parts
+		}
+
+		buf = buf[length:]
+	}
+
+	return frames, nil
+}
+
+/*
+Passthrough is a faster alternative to running Listen, Filter, and Send, for
+when every tier can be sent the values parts exactly as Coco received them.
+
+Packets are split into Frames rather than decoded, filtered against the
+blacklist, then buffered and dispatched to every tier. The work is done in a
+single goroutine, and samples don't cross any channels on their way through.
+*/
+func Passthrough(config Config, rules *RuleSet, skews *SkewTracker, tiers *[]Tier, blacklist chan BlacklistItem) {
+	// Initialise the error counts
+	errorCounts.Add("passthrough.split", 0)
+	errorCounts.Add("send.write", 0)
+	errorCounts.Add("send.disconnected", 0)
+	errorCounts.Add("send.seal", 0)
+	errorCounts.Add("send.oversize", 0)
+	errorCounts.Add("send.encode", 0)
+	errorCounts.Add("send.webhook", 0)
+
+	// Tiers aren't safe to dispatch to concurrently, so there's only one reader
+	conns, err := listenUDP(config.Listen, 1)
+	if err != nil {
+		log.Fatalln("[fatal] Passthrough:", err)
+	}
+	conn := conns[0]
+	go watchDrops(conns)
+	normaliser, err := NewNormaliser(config.Normalise)
+	if err != nil {
+		log.Fatalln("[fatal] Passthrough:", err)
+	}
+	acl, err := NewACL(config.Listen, normaliser)
+	if err != nil {
+		log.Fatalln("[fatal] Passthrough:", err)
+	}
+	relabeller, err := NewRelabeller(config.Relabel)
+	if err != nil {
+		log.Fatalln("[fatal] Passthrough:", err)
+	}
+
+	initClockCounts()
+	var deduper *Deduper
+	if config.Dedup.Enabled {
+		initDedupCounts()
+		deduper = NewDeduper(config.Dedup)
+	}
+	BuildTiers(tiers)
+
+	// Frames are dispatched before the next read, so the buffer can be reused
+	buf := make([]byte, MaxPacketSize)
+	interval := config.Send.Interval()
+	flush := time.Now().Add(interval)
+	for {
+		// Wake up to flush the buffers, even if no packets are received
+		conn.SetReadDeadline(flush)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if time.Now().After(flush) {
+			for _, tier := range *tiers {
+				for target := range tier.Buffers {
+					tier.Flush(target)
+				}
+			}
+			flush = time.Now().Add(interval)
+		}
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				log.Println("[error] Passthrough: Failed to receive packet", err)
+				errorCounts.Add("fetch.receive", 1)
+			}
+			continue
+		}
+		listenCounts.Add("raw", 1)
+		if !acl.Allowed(addr.IP) {
+			continue
+		}
+
+		// Verify or decrypt the packet, if we need to
+		payload, err := Open(config.Listen, buf[0:n])
+		if err != nil {
+			continue
+		}
+
+		frames, err := Split(payload)
+		if err != nil {
+			errorCounts.Add("passthrough.split", 1)
+			keepMalformed(addr.String(), payload, err)
+			continue
+		}
+		for _, frame := range frames {
+			listenCounts.Add("decoded", 1)
+			packet := frame.Packet
+			packet.Hostname = normaliser.Hostname(packet.Hostname)
+			if !acl.HostAllowed(packet.Hostname, addr.IP) {
+				continue
+			}
+			for _, name := range relabeller.Relabel(&packet) {
+				relabelCounts.Add(name, 1)
+			}
+			if !CheckClock(config.Clock, skews, &packet, time.Now()) {
+				continue
+			}
+			frame.Packet = packet
+			if allowed, rule := rules.Rules().Allowed(packet); !allowed {
+				blacklist <- BlacklistItem{Packet: packet, Time: time.Now().Unix(), Rule: rule.Name}
+				filterCounts.Add("rejected", 1)
+				continue
+			}
+			filterCounts.Add("accepted", 1)
+			if deduper != nil {
+				duplicate := deduper.Duplicate(frame, time.Now())
+				countDedup(duplicate)
+				if duplicate {
+					continue
+				}
+			}
+			for _, tier := range *tiers {
+				tier.Dispatch(frame)
+			}
+		}
+
+		// Notifications are rare, so they're dispatched as soon as they arrive
+		notifications, _ := Notifications(payload)
+		for _, n := range notifications {
+			listenCounts.Add("notifications", 1)
+			n.Hostname = normaliser.Hostname(n.Hostname)
+			if !acl.HostAllowed(n.Hostname, addr.IP) {
+				continue
+			}
+			notify(config.Send, tiers, n)
+		}
+	}
+}
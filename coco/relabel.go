@@ -0,0 +1,181 @@
+package coco
+
+import (
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// Fields a relabel rule can rewrite.
+const (
+	FieldHost           = "host"
+	FieldPlugin         = "plugin"
+	FieldPluginInstance = "plugin_instance"
+	FieldType           = "type"
+	FieldTypeInstance   = "type_instance"
+)
+
+// relabelRule is a compiled relabel rule.
+type relabelRule struct {
+	name        string
+	field       string
+	pattern     *regexp.Regexp
+	replacement string
+	metric      *regexp.Regexp
+}
+
+// Relabeller rewrites the fields of samples, so samples renamed between
+// versions of a plugin are hashed and stored under one name.
+type Relabeller struct {
+	rules []relabelRule
+}
+
+// NewRelabeller compiles the rules in a relabel config. Rules without a name
+// are named by their position in the list of rules.
+//
+// Data sources can't be rewritten: the collectd protocol doesn't carry their
+// names, so targets name them from their own types.db whatever Relabel does.
+func NewRelabeller(config RelabelConfig) (*Relabeller, error) {
+	r := &Relabeller{}
+	for i, rc := range config.Rules {
+		rule := relabelRule{name: rc.Name, field: rc.Field, replacement: rc.Replacement}
+		if len(rule.name) == 0 {
+			rule.name = strconv.Itoa(i)
+		}
+		switch rule.field {
+		case FieldHost, FieldPlugin, FieldPluginInstance, FieldType, FieldTypeInstance:
+		case "data_source":
+			return nil, fmt.Errorf("relabel rule %s can't rewrite data sources, which aren't sent to targets", rule.name)
+		default:
+			return nil, fmt.Errorf("relabel rule %s has invalid field '%s'", rule.name, rule.field)
+		}
+		var err error
+		if rule.pattern, err = regexp.Compile(rc.Pattern); err != nil {
+			return nil, fmt.Errorf("relabel rule %s has invalid pattern '%s': %s", rule.name, rc.Pattern, err)
+		}
+		if len(rc.Metric) > 0 {
+			if rule.metric, err = regexp.Compile(rc.Metric); err != nil {
+				return nil, fmt.Errorf("relabel rule %s has invalid metric '%s': %s", rule.name, rc.Metric, err)
+			}
+		}
+		relabelCounts.Add(rule.name, 0)
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// field finds the field of a sample a rule rewrites.
+func field(packet *collectd.Packet, name string) *string {
+	switch name {
+	case FieldHost:
+		return &packet.Hostname
+	case FieldPlugin:
+		return &packet.Plugin
+	case FieldPluginInstance:
+		return &packet.PluginInstance
+	case FieldType:
+		return &packet.Type
+	case FieldTypeInstance:
+		return &packet.TypeInstance
+	}
+	return nil
+}
+
+/*
+Relabel applies each rule to a sample in order, and returns the names of the
+rules that changed it.
+
+A rule only applies to samples whose host/metric name matches the rule's
+metric regex, if it has one. The field's value is matched against the rule's
+pattern, and replaced with the replacement if it matches, expanding $1 style
+references to groups in the pattern.
+*/
+func (r *Relabeller) Relabel(packet *collectd.Packet) []string {
+	var applied []string
+	for _, rule := range r.rules {
+		if rule.metric != nil && !rule.metric.MatchString(packet.Hostname+"/"+MetricName(*packet)) {
+			continue
+		}
+
+		f := field(packet, rule.field)
+		if !rule.pattern.MatchString(*f) {
+			continue
+		}
+		s := rule.pattern.ReplaceAllString(*f, rule.replacement)
+		if s != *f {
+			*f = s
+			applied = append(applied, rule.name)
+		}
+	}
+	return applied
+}
+
+// Relabel takes samples from Normalise, rewrites them with the relabel rules,
+// and queues them for Clock.
+func Relabel(config RelabelConfig, in chan collectd.Packet, out chan collectd.Packet) {
+	r, err := NewRelabeller(config)
+	if err != nil {
+		log.Fatalln("[fatal] Relabel:", err)
+	}
+
+	for {
+		packet := <-in
+		for _, name := range r.Relabel(&packet) {
+			relabelCounts.Add(name, 1)
+		}
+		out <- packet
+	}
+}
+
+// RelabelSample is a sample to show the relabel rules applied to.
+type RelabelSample struct {
+	Host           string `json:"host"`
+	Plugin         string `json:"plugin"`
+	PluginInstance string `json:"plugin_instance"`
+	Type           string `json:"type"`
+	TypeInstance   string `json:"type_instance"`
+	// host/metric, as it's matched by the filter and hashed
+	Name string `json:"name"`
+}
+
+// relabelSample describes a sample for the dry run.
+func relabelSample(packet collectd.Packet) RelabelSample {
+	s := RelabelSample{
+		Host:           packet.Hostname,
+		Plugin:         packet.Plugin,
+		PluginInstance: packet.PluginInstance,
+		Type:           packet.Type,
+		TypeInstance:   packet.TypeInstance,
+		Name:           packet.Hostname + "/" + MetricName(packet),
+	}
+	return s
+}
+
+// RelabelResult is a sample before and after relabelling, and the rules that
+// changed it.
+type RelabelResult struct {
+	Before RelabelSample `json:"before"`
+	After  RelabelSample `json:"after"`
+	Rules  []string      `json:"rules"`
+}
+
+// RelabelDryRun shows how the relabel rules would rewrite a sample, given as
+// query parameters named like the fields rules rewrite.
+func RelabelDryRun(w http.ResponseWriter, req *http.Request, r *Relabeller) {
+	qs := req.URL.Query()
+	packet := collectd.Packet{
+		Hostname:       qs.Get(FieldHost),
+		Plugin:         qs.Get(FieldPlugin),
+		PluginInstance: qs.Get(FieldPluginInstance),
+		Type:           qs.Get(FieldType),
+		TypeInstance:   qs.Get(FieldTypeInstance),
+	}
+
+	result := RelabelResult{Before: relabelSample(packet)}
+	result.Rules = r.Relabel(&packet)
+	result.After = relabelSample(packet)
+	respondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,23 @@
+//go:build linux && (386 || amd64 || arm || arm64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package coco
+
+import (
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define. It
+// differs on MIPS, PA-RISC, and SPARC, so those fall back to a single reader.
+const soReusePort = 0xf
+
+// reusePort sets SO_REUSEPORT on a socket before it's bound, so several
+// sockets can be bound to the same address.
+func reusePort(network string, address string, c syscall.RawConn) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); e != nil {
+		return e
+	}
+	return err
+}
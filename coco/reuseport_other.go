@@ -0,0 +1,14 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package coco
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort is only supported on Linux, so only one reader can be used
+// elsewhere.
+func reusePort(network string, address string, c syscall.RawConn) error {
+	return errors.New("multiple readers require SO_REUSEPORT, which isn't supported on this platform")
+}
@@ -0,0 +1,125 @@
+package coco
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	collectd "github.com/kimor79/gollectd"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RuleStatus is a filter rule, and how many samples have matched it first.
+type RuleStatus struct {
+	RuleConfig
+	Hits int64 `json:"hits"`
+}
+
+// RuleSample is a sample to test the filter rules with.
+type RuleSample struct {
+	Host           string `json:"host"`
+	Plugin         string `json:"plugin"`
+	PluginInstance string `json:"plugin_instance"`
+	Type           string `json:"type"`
+	TypeInstance   string `json:"type_instance"`
+}
+
+// RuleTestResult is whether a sample would be allowed, and the rule that
+// decided it, if any.
+type RuleTestResult struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// respondJSON writes a value as a JSON response.
+func respondJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	data, _ := json.Marshal(v)
+	w.Write(data)
+}
+
+// authorize rejects requests to manage filter rules unless they present the
+// configured token. Without a token, rules can't be managed at all.
+func authorize(w http.ResponseWriter, req *http.Request, token string, manage bool) {
+	if !manage || len(token) == 0 {
+		respondJSON(w, http.StatusForbidden, map[string]string{"error": "filter rules can't be managed without a token"})
+		return
+	}
+	presented := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		errorCounts.Add("api.unauthorized", 1)
+		respondJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+	}
+}
+
+// ListRules responds with the filter rules, in the order they're checked.
+func ListRules(w http.ResponseWriter, rules *RuleSet) {
+	hits := make(map[string]int64)
+	for _, rule := range rules.Rules() {
+		hits[rule.Name] = rule.Hits()
+	}
+	var result []RuleStatus
+	for _, rc := range rules.List() {
+		result = append(result, RuleStatus{RuleConfig: rc, Hits: hits[rc.Name]})
+	}
+	respondJSON(w, http.StatusOK, result)
+}
+
+// AddRule adds a filter rule posted as JSON, at the position given by the
+// ?position parameter, or after the other rules.
+func AddRule(w http.ResponseWriter, req *http.Request, rules *RuleSet) {
+	var rc RuleConfig
+	if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	position := -1
+	if p := req.URL.Query().Get("position"); len(p) > 0 {
+		var err error
+		if position, err = strconv.Atoi(p); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid position"})
+			return
+		}
+	}
+	if err := rules.Add(rc, position); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusCreated, rc)
+}
+
+// RemoveRule removes a filter rule by name.
+func RemoveRule(w http.ResponseWriter, rules *RuleSet, name string) {
+	switch err := rules.Remove(name); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrRuleNotFound:
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+// CheckRules checks which rule a sample posted as JSON would match, without
+// counting a hit.
+func CheckRules(w http.ResponseWriter, req *http.Request, rules *RuleSet) {
+	var s RuleSample
+	if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	packet := collectd.Packet{
+		Hostname:       s.Host,
+		Plugin:         s.Plugin,
+		PluginInstance: s.PluginInstance,
+		Type:           s.Type,
+		TypeInstance:   s.TypeInstance,
+	}
+	result := RuleTestResult{Allowed: true}
+	if rule := rules.Rules().Match(packet); rule != nil {
+		result.Allowed = rule.Action == RuleAllow
+		result.Rule = rule.Name
+	}
+	respondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,346 @@
+package coco
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	collectd "github.com/kimor79/gollectd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Rule actions.
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+)
+
+// Rules added at runtime are removed by name in a URL path, so their names
+// must be safe to put in one.
+var ruleName = regexp.MustCompile(`^[A-Za-z0-9_~-][A-Za-z0-9._~-]*$`)
+
+// ErrRuleNotFound is returned when removing a rule that doesn't exist.
+var ErrRuleNotFound = errors.New("rule not found")
+
+// Rule is a compiled filter rule. Each field is matched separately, and
+// fields without a pattern match anything.
+type Rule struct {
+	Name           string
+	Action         string
+	host           *regexp.Regexp
+	plugin         *regexp.Regexp
+	pluginInstance *regexp.Regexp
+	typ            *regexp.Regexp
+	typeInstance   *regexp.Regexp
+	// The legacy blacklist matches host/metric, rather than a single field
+	full *regexp.Regexp
+	// Number of samples that matched the rule first
+	hits *expvar.Int
+}
+
+// Hits returns the number of samples that have matched the rule first.
+func (r *Rule) Hits() int64 {
+	return r.hits.Value()
+}
+
+// compileField compiles a rule's pattern for one field, if it has one.
+func compileField(name string, field string, pattern string) (*regexp.Regexp, error) {
+	if len(pattern) == 0 {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s has invalid %s '%s': %s", name, field, pattern, err)
+	}
+	return re, nil
+}
+
+// CompileRule compiles a rule's patterns. Rules without a name are named by
+// their position in the list of rules.
+func CompileRule(config RuleConfig, i int) (*Rule, error) {
+	rule := &Rule{Name: config.Name, Action: config.Action, hits: new(expvar.Int)}
+	if len(rule.Name) == 0 {
+		rule.Name = strconv.Itoa(i)
+	}
+	switch rule.Action {
+	case RuleAllow, RuleDeny:
+	default:
+		return nil, fmt.Errorf("rule %s has invalid action '%s'", rule.Name, rule.Action)
+	}
+
+	var err error
+	if rule.host, err = compileField(rule.Name, "host", config.Host); err != nil {
+		return nil, err
+	}
+	if rule.plugin, err = compileField(rule.Name, "plugin", config.Plugin); err != nil {
+		return nil, err
+	}
+	if rule.pluginInstance, err = compileField(rule.Name, "plugin_instance", config.PluginInstance); err != nil {
+		return nil, err
+	}
+	if rule.typ, err = compileField(rule.Name, "type", config.Type); err != nil {
+		return nil, err
+	}
+	if rule.typeInstance, err = compileField(rule.Name, "type_instance", config.TypeInstance); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// matchField checks a field against a rule's pattern for it.
+func matchField(re *regexp.Regexp, s string) bool {
+	return re == nil || re.MatchString(s)
+}
+
+// Match checks if a sample matches every pattern in the rule.
+func (r *Rule) Match(packet collectd.Packet) bool {
+	if r.full != nil {
+		return r.full.MatchString(packet.Hostname + "/" + MetricName(packet))
+	}
+	return matchField(r.host, packet.Hostname) &&
+		matchField(r.plugin, packet.Plugin) &&
+		matchField(r.pluginInstance, packet.PluginInstance) &&
+		matchField(r.typ, packet.Type) &&
+		matchField(r.typeInstance, packet.TypeInstance)
+}
+
+// Rules is an ordered list of filter rules, compiled once.
+type Rules []*Rule
+
+/*
+CompileRules compiles the rules in a filter config, in order. The blacklist
+regex, if there is one, is compiled as a final deny rule named "blacklist",
+matched against host/metric like it always has been.
+*/
+func CompileRules(config FilterConfig) (Rules, error) {
+	var rules Rules
+	for i, rc := range config.Rules {
+		rule, err := CompileRule(rc, i)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if len(config.Blacklist) > 0 {
+		re, err := regexp.Compile(config.Blacklist)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blacklist '%s': %s", config.Blacklist, err)
+		}
+		rules = append(rules, &Rule{Name: "blacklist", Action: RuleDeny, full: re, hits: new(expvar.Int)})
+	}
+	return rules, nil
+}
+
+// Match finds the first rule a sample matches, or nil if it doesn't match any.
+func (rules Rules) Match(packet collectd.Packet) *Rule {
+	for _, rule := range rules {
+		if rule.Match(packet) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// denies checks if a sample would be rejected, without counting a hit.
+func (rules Rules) denies(packet collectd.Packet) bool {
+	rule := rules.Match(packet)
+	return rule != nil && rule.Action == RuleDeny
+}
+
+// Allowed checks a sample against the rules, and counts a hit on the first
+// rule it matches. Samples that don't match any rule are allowed, and no rule
+// is returned.
+func (rules Rules) Allowed(packet collectd.Packet) (bool, *Rule) {
+	rule := rules.Match(packet)
+	if rule == nil {
+		return true, nil
+	}
+	rule.hits.Add(1)
+	return rule.Action == RuleAllow, rule
+}
+
+// ruleFile is the format rules are saved to the rules file in.
+type ruleFile struct {
+	Rules []RuleConfig `toml:"rule"`
+}
+
+/*
+RuleSet holds the filter rules shared by every Filter goroutine, and lets them
+be changed while Coco is running.
+
+Changes are compiled before they're applied, and swapped in atomically, so
+Filter always sees a complete set of rules. If there's a rules file, changes
+are saved to it before they're applied.
+
+Each rule's hits are kept with the rule, and carried over when other rules
+change, so removing a rule and adding another with the same name starts its
+count again. Rules without a name are named by their position when the rules
+are loaded, so the names stay with the rules when rules are inserted before
+them.
+*/
+type RuleSet struct {
+	mutex     sync.Mutex
+	configs   []RuleConfig
+	blacklist string
+	file      string
+	rules     atomic.Value
+}
+
+// NewRuleSet compiles the rules in a filter config, or the rules saved in the
+// rules file, if it exists.
+func NewRuleSet(config FilterConfig) (*RuleSet, error) {
+	rs := &RuleSet{configs: config.Rules, blacklist: config.Blacklist, file: config.RulesFile}
+	if len(rs.file) > 0 {
+		var f ruleFile
+		_, err := toml.DecodeFile(rs.file, &f)
+		switch {
+		case err == nil:
+			rs.configs = f.Rules
+		case !os.IsNotExist(err):
+			return nil, fmt.Errorf("failed to read rules file: %s", err)
+		}
+	}
+
+	// Name rules by their position once, so they keep their names
+	rs.configs = append([]RuleConfig{}, rs.configs...)
+	for i := range rs.configs {
+		if len(rs.configs[i].Name) == 0 {
+			rs.configs[i].Name = strconv.Itoa(i)
+		}
+	}
+
+	rules, err := CompileRules(FilterConfig{Blacklist: rs.blacklist, Rules: rs.configs})
+	if err != nil {
+		return nil, err
+	}
+	publishRules(nil, rules)
+	rs.rules.Store(rules)
+	return rs, nil
+}
+
+// publishRules exports the hits of the current rules in coco.filter.rules, and
+// stops exporting rules that have been removed.
+func publishRules(old Rules, rules Rules) {
+	current := make(map[string]bool)
+	for _, rule := range rules {
+		ruleCounts.Set(rule.Name, rule.hits)
+		current[rule.Name] = true
+	}
+	for _, rule := range old {
+		if !current[rule.Name] {
+			ruleCounts.Delete(rule.Name)
+		}
+	}
+}
+
+// Rules returns the current rules.
+func (rs *RuleSet) Rules() Rules {
+	return rs.rules.Load().(Rules)
+}
+
+// List returns the configs of the current rules, in order, all of them named.
+// The blacklist isn't included.
+func (rs *RuleSet) List() []RuleConfig {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return append([]RuleConfig{}, rs.configs...)
+}
+
+// update compiles and saves a new list of rules, then swaps them in.
+func (rs *RuleSet) update(configs []RuleConfig) error {
+	rules, err := CompileRules(FilterConfig{Blacklist: rs.blacklist, Rules: configs})
+	if err != nil {
+		return err
+	}
+
+	// Carry over the hits of rules that haven't changed
+	old := rs.Rules()
+	hits := make(map[string]*expvar.Int)
+	for _, rule := range old {
+		hits[rule.Name] = rule.hits
+	}
+	for _, rule := range rules {
+		if h, ok := hits[rule.Name]; ok {
+			rule.hits = h
+		}
+	}
+
+	if len(rs.file) > 0 {
+		if err := saveRules(rs.file, configs); err != nil {
+			errorCounts.Add("filter.rules.save", 1)
+			return fmt.Errorf("failed to save rules file: %s", err)
+		}
+	}
+	rs.configs = configs
+	publishRules(old, rules)
+	rs.rules.Store(rules)
+	return nil
+}
+
+// Add inserts a rule at a position in the list, or appends it if the position
+// is out of range. Rules added at runtime must have a unique name, so they can
+// be removed.
+func (rs *RuleSet) Add(config RuleConfig, position int) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if len(config.Name) == 0 {
+		return errors.New("rule needs a name")
+	}
+	if !ruleName.MatchString(config.Name) {
+		return fmt.Errorf("rule name '%s' can only contain letters, digits, '-', '_', '.', and '~', and can't start with '.'", config.Name)
+	}
+	if config.Name == "blacklist" {
+		return errors.New("rule can't be named blacklist")
+	}
+	for _, rc := range rs.configs {
+		if rc.Name == config.Name {
+			return fmt.Errorf("rule %s already exists", config.Name)
+		}
+	}
+
+	configs := append([]RuleConfig{}, rs.configs...)
+	if position < 0 || position >= len(configs) {
+		configs = append(configs, config)
+	} else {
+		configs = append(configs[:position], append([]RuleConfig{config}, configs[position:]...)...)
+	}
+	return rs.update(configs)
+}
+
+// Remove removes a rule by name.
+func (rs *RuleSet) Remove(name string) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	for i, rc := range rs.configs {
+		if rc.Name == name {
+			configs := append([]RuleConfig{}, rs.configs[:i]...)
+			return rs.update(append(configs, rs.configs[i+1:]...))
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// saveRules writes rules to a file, replacing it atomically.
+func saveRules(path string, configs []RuleConfig) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := toml.NewEncoder(f).Encode(ruleFile{Rules: configs}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,249 @@
+package coco
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"strings"
+)
+
+// Security levels, as per collectd's network plugin SecurityLevel option.
+const (
+	SecurityLevelNone    = "none"
+	SecurityLevelSign    = "sign"
+	SecurityLevelEncrypt = "encrypt"
+)
+
+var (
+	ErrUnsigned      = errors.New("packet is not signed")
+	ErrUnencrypted   = errors.New("packet is not encrypted")
+	ErrUnknownUser   = errors.New("packet signed by unknown user")
+	ErrBadSignature  = errors.New("packet signature does not match")
+	ErrBadEncryption = errors.New("packet could not be decrypted")
+)
+
+// signatureHeaderLength is the size of a signature part, minus the username:
+// type(2) + length(2) + HMAC-SHA-256(32)
+const signatureHeaderLength = 4 + sha256.Size
+
+// encryptionHeaderLength is the size of an encryption part, minus the
+// username and payload: type(2) + length(2) + username length(2) + IV(16) +
+// SHA-1 of the payload(20)
+const encryptionHeaderLength = 6 + aes.BlockSize + sha1.Size
+
+// securityLevel normalises a configured security level, so "Sign" in the
+// collectd config maps to "sign" in Coco.
+func securityLevel(level string) (string, error) {
+	switch l := strings.ToLower(level); l {
+	case "":
+		return SecurityLevelNone, nil
+	case SecurityLevelNone, SecurityLevelSign, SecurityLevelEncrypt:
+		return l, nil
+	default:
+		return "", fmt.Errorf("unknown security level '%s'", level)
+	}
+}
+
+/*
+Open checks the security parts on a collectd datagram, and returns the payload
+that should be handed to collectd.Packets.
+
+Encrypted packets are decrypted with the key for the sending user, and dropped
+if they can't be decrypted. Signed packets are verified against the key for the
+signing user. How everything else is handled depends on the security level:
+
+  - none: all packets are accepted. Signed packets that can't be verified
+    are counted, but still accepted, so keys can be rolled out to clients
+    before verification is enforced.
+  - sign: encrypted packets and verified signed packets are accepted.
+    Unsigned packets, and signed packets that can't be verified, are counted
+    and dropped.
+  - encrypt: only encrypted packets are accepted.
+*/
+func Open(config ListenConfig, buf []byte) ([]byte, error) {
+	level, err := securityLevel(config.SecurityLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	var part uint16
+	if len(buf) >= 4 {
+		part = binary.BigEndian.Uint16(buf[0:2])
+	}
+
+	switch {
+	case part == collectd.ParseEncryption:
+		payload, err := decrypt(config.Users, buf)
+		if err != nil {
+			switch err {
+			case ErrUnknownUser:
+				errorCounts.Add("listen.security.unknown_user", 1)
+			default:
+				errorCounts.Add("listen.security.decrypt", 1)
+			}
+			return nil, err
+		}
+		return payload, nil
+	case level == SecurityLevelEncrypt:
+		errorCounts.Add("listen.security.unencrypted", 1)
+		return nil, ErrUnencrypted
+	case part == collectd.ParseSignature:
+		payload, err := verify(config.Users, buf)
+		if err != nil {
+			switch err {
+			case ErrUnknownUser:
+				errorCounts.Add("listen.security.unknown_user", 1)
+			default:
+				errorCounts.Add("listen.security.bad_signature", 1)
+			}
+			if level != SecurityLevelNone {
+				return nil, err
+			}
+		}
+		return payload, nil
+	case level == SecurityLevelSign:
+		errorCounts.Add("listen.security.unsigned", 1)
+		return nil, ErrUnsigned
+	default:
+		return buf, nil
+	}
+}
+
+// verify checks the HMAC-SHA-256 signature part at the start of buf, and
+// returns the signed payload that follows it.
+func verify(users map[string]string, buf []byte) ([]byte, error) {
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	if length <= signatureHeaderLength || length > len(buf) {
+		return nil, collectd.ErrorInvalid
+	}
+	sum := buf[4:signatureHeaderLength]
+	username := buf[signatureHeaderLength:length]
+	payload := buf[length:]
+
+	key, ok := users[string(username)]
+	if !ok {
+		return payload, ErrUnknownUser
+	}
+
+	// The signature covers the username, and everything after the signature part
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(username)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return payload, ErrBadSignature
+	}
+	return payload, nil
+}
+
+// decrypt decrypts the AES-256-OFB encryption part at the start of buf, and
+// returns the payload after checking it against its SHA-1 hash.
+func decrypt(users map[string]string, buf []byte) ([]byte, error) {
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	if length > len(buf) || length < 6 {
+		return nil, collectd.ErrorInvalid
+	}
+	usernameLength := int(binary.BigEndian.Uint16(buf[4:6]))
+	if length < encryptionHeaderLength+usernameLength {
+		return nil, collectd.ErrorInvalid
+	}
+	username := buf[6 : 6+usernameLength]
+	iv := buf[6+usernameLength : 6+usernameLength+aes.BlockSize]
+	encrypted := buf[6+usernameLength+aes.BlockSize : length]
+
+	password, ok := users[string(username)]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+
+	// collectd derives the AES-256 key from a SHA-256 of the password
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewOFB(block, iv).XORKeyStream(plain, encrypted)
+
+	sum := sha1.Sum(plain[sha1.Size:])
+	if !bytes.Equal(sum[:], plain[:sha1.Size]) {
+		return nil, ErrBadEncryption
+	}
+	return plain[sha1.Size:], nil
+}
+
+// Sign wraps a collectd payload in a HMAC-SHA-256 signature part.
+func Sign(payload []byte, username string, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(username))
+	mac.Write(payload)
+
+	buf := make([]byte, 4, signatureHeaderLength+len(username)+len(payload))
+	binary.BigEndian.PutUint16(buf[0:2], collectd.ParseSignature)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(signatureHeaderLength+len(username)))
+	buf = append(buf, mac.Sum(nil)...)
+	buf = append(buf, username...)
+	return append(buf, payload...)
+}
+
+// Encrypt wraps a collectd payload in an AES-256-OFB encryption part.
+func Encrypt(payload []byte, username string, password string) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(payload)
+	plain := append(sum[:], payload...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(encrypted, plain)
+
+	buf := make([]byte, 6, 6+len(username)+len(iv)+len(encrypted))
+	binary.BigEndian.PutUint16(buf[0:2], collectd.ParseEncryption)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(cap(buf)))
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(username)))
+	buf = append(buf, username...)
+	buf = append(buf, iv...)
+	return append(buf, encrypted...), nil
+}
+
+// Seal signs or encrypts a payload before it is dispatched to the tier's
+// targets, as per the tier's security level.
+func (t *Tier) Seal(payload []byte) ([]byte, error) {
+	level, err := securityLevel(t.SecurityLevel)
+	if err != nil {
+		return nil, err
+	}
+	switch level {
+	case SecurityLevelSign:
+		return Sign(payload, t.Username, t.Password), nil
+	case SecurityLevelEncrypt:
+		return Encrypt(payload, t.Username, t.Password)
+	default:
+		return payload, nil
+	}
+}
+
+// overhead is the number of bytes signing or encrypting adds to a payload.
+func (t *Tier) overhead() int {
+	switch strings.ToLower(t.SecurityLevel) {
+	case SecurityLevelSign:
+		return signatureHeaderLength + len(t.Username)
+	case SecurityLevelEncrypt:
+		return encryptionHeaderLength + len(t.Username)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,280 @@
+package coco
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrStatsDLine = errors.New("statsd line is not 'name:value|type'")
+
+// statsdKey identifies a StatsD metric from a host.
+type statsdKey struct {
+	host string
+	name string
+}
+
+/*
+StatsD aggregates StatsD metrics over a flush interval, and turns them into
+samples the same way collectd's statsd plugin does:
+
+  - counters are sent as a running total, with the derive type
+  - gauges are sent as their last value, with the gauge type
+  - timers are sent as their average, lower, upper, sum, and percentiles in
+    seconds, with the latency type, and their count with the gauge type
+  - sets are sent as the number of unique values seen, with the objects type
+
+Counters and gauges are sent every flush once they have been seen, until
+they go idle_flushes flushes without an update, like collectd's DeleteCounters
+and DeleteGauges. Timers and sets are only sent for flush intervals they were
+updated in.
+*/
+type StatsD struct {
+	config   StatsDConfig
+	host     string
+	mutex    sync.Mutex
+	counters map[statsdKey]float64
+	gauges   map[statsdKey]float64
+	timers   map[statsdKey][]float64
+	sets     map[statsdKey]map[string]bool
+	// Flushes since each counter and gauge was last updated
+	countersIdle map[statsdKey]int
+	gaugesIdle   map[statsdKey]int
+}
+
+// NewStatsD returns a StatsD that aggregates metrics for the configured host.
+func NewStatsD(config StatsDConfig) *StatsD {
+	host := config.Host
+	if len(host) == 0 {
+		host, _ = os.Hostname()
+	}
+	return &StatsD{
+		config:   config,
+		host:     host,
+		counters: map[statsdKey]float64{},
+		gauges:   map[statsdKey]float64{},
+		timers:   map[statsdKey][]float64{},
+		sets:     map[statsdKey]map[string]bool{},
+
+		countersIdle: map[statsdKey]int{},
+		gaugesIdle:   map[statsdKey]int{},
+	}
+}
+
+// Add parses a StatsD line, like "name:value|type|@rate|#tag:value", and
+// aggregates it.
+func (s *StatsD) Add(line string) error {
+	fields := strings.Split(line, "|")
+	colon := strings.LastIndex(fields[0], ":")
+	if len(fields) < 2 || colon < 1 {
+		return ErrStatsDLine
+	}
+	name, value := fields[0][:colon], fields[0][colon+1:]
+
+	key := statsdKey{host: s.host, name: name}
+	rate := 1.0
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			r, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return ErrStatsDLine
+			}
+			rate = r
+		case strings.HasPrefix(f, "#"):
+			if len(s.config.HostTag) == 0 {
+				continue
+			}
+			for _, tag := range strings.Split(f[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 2 && kv[0] == s.config.HostTag && len(kv[1]) > 0 {
+					key.host = kv[1]
+				}
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kind := fields[1]
+	if kind == "s" {
+		if s.sets[key] == nil {
+			s.sets[key] = map[string]bool{}
+		}
+		s.sets[key][value] = true
+		return nil
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return ErrStatsDLine
+	}
+	switch kind {
+	case "c":
+		s.counters[key] += n / rate
+		s.countersIdle[key] = 0
+	case "g":
+		s.gaugesIdle[key] = 0
+		// Gauges with a sign are adjusted, rather than set
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			s.gauges[key] += n
+		} else {
+			s.gauges[key] = n
+		}
+	case "ms", "h":
+		s.timers[key] = append(s.timers[key], n)
+	default:
+		return ErrStatsDLine
+	}
+	return nil
+}
+
+// percentile returns the nearest rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// expireIdle forgets the values that haven't been updated for limit flushes,
+// and counts another flush for the rest.
+func expireIdle(values map[statsdKey]float64, idle map[statsdKey]int, limit int) {
+	for key := range values {
+		if idle[key] >= limit {
+			delete(values, key)
+			delete(idle, key)
+			continue
+		}
+		idle[key]++
+	}
+}
+
+// Flush turns the aggregated metrics into samples, and resets the timers and
+// sets for the next flush interval. Counters and gauges that have been idle
+// for too many flushes are forgotten, rather than sent.
+func (s *StatsD) Flush(now time.Time) []collectd.Packet {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expireIdle(s.counters, s.countersIdle, s.config.idleFlushes())
+	expireIdle(s.gauges, s.gaugesIdle, s.config.idleFlushes())
+
+	var packets []collectd.Packet
+	sample := func(key statsdKey, kind string, instance string, value float64) {
+		var t uint8 = collectd.TypeGauge
+		if kind == "derive" {
+			t = collectd.TypeDerive
+		}
+		packets = append(packets, collectd.Packet{
+			Hostname:     key.host,
+			Plugin:       "statsd",
+			Type:         kind,
+			TypeInstance: instance,
+			Time:         uint64(now.Unix()),
+			Interval:     uint64(s.config.Interval().Seconds()),
+			Values: []collectd.Value{
+				{Name: "value", Type: t, TypeName: collectd.ValueTypeValues[t], Value: value},
+			},
+		})
+	}
+
+	for key, total := range s.counters {
+		sample(key, "derive", key.name, math.Floor(total))
+	}
+	for key, value := range s.gauges {
+		sample(key, "gauge", key.name, value)
+	}
+	for key, values := range s.timers {
+		// Timers are received in milliseconds, and sent in seconds
+		sort.Float64s(values)
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		sample(key, "latency", key.name+"-average", sum/float64(len(values))/1000)
+		sample(key, "latency", key.name+"-lower", values[0]/1000)
+		sample(key, "latency", key.name+"-upper", values[len(values)-1]/1000)
+		sample(key, "latency", key.name+"-sum", sum/1000)
+		sample(key, "gauge", key.name+"-count", float64(len(values)))
+		for _, p := range s.config.percentiles() {
+			instance := fmt.Sprintf("%s-percentile-%s", key.name, strconv.FormatFloat(p, 'f', -1, 64))
+			sample(key, "latency", instance, percentile(values, p)/1000)
+		}
+	}
+	for key, set := range s.sets {
+		sample(key, "objects", key.name, float64(len(set)))
+	}
+
+	s.timers = map[statsdKey][]float64{}
+	s.sets = map[statsdKey]map[string]bool{}
+	return packets
+}
+
+/*
+ListenStatsD takes StatsD metrics over UDP, and every flush interval queues
+the aggregated samples for Filter.
+*/
+func ListenStatsD(config StatsDConfig, c chan collectd.Packet) {
+	// Initialise the error counts
+	errorCounts.Add("listen.statsd.receive", 0)
+	errorCounts.Add("listen.statsd.parse", 0)
+
+	addr, err := net.ResolveUDPAddr("udp", config.Bind)
+	if err != nil {
+		log.Fatalln("[fatal] ListenStatsD: failed to resolve address", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalln("[fatal] ListenStatsD: failed to listen", err)
+	}
+	log.Printf("[info] ListenStatsD: listening on %s\n", config.Bind)
+
+	statsd := NewStatsD(config)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				log.Println("[error] ListenStatsD: Failed to receive packet", err)
+				errorCounts.Add("listen.statsd.receive", 1)
+				continue
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(buf[:n]))
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if len(line) == 0 {
+					continue
+				}
+				listenCounts.Add("statsd.raw", 1)
+				if err := statsd.Add(line); err != nil {
+					errorCounts.Add("listen.statsd.parse", 1)
+				}
+			}
+		}
+	}()
+
+	tick := time.NewTicker(config.Interval()).C
+	for now := range tick {
+		for _, p := range statsd.Flush(now) {
+			listenCounts.Add("decoded", 1)
+			c <- p
+		}
+	}
+}
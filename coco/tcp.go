@@ -0,0 +1,180 @@
+package coco
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	collectd "github.com/kimor79/gollectd"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection holds stats about a TCP connection Listen is receiving packets on.
+type Connection struct {
+	Remote    string `json:"remote"`
+	TLS       bool   `json:"tls"`
+	Client    string `json:"client,omitempty"`
+	Connected int64  `json:"connected"`
+	LastSeen  int64  `json:"last_seen"`
+	Packets   int64  `json:"packets"`
+	Bytes     int64  `json:"bytes"`
+}
+
+var connections = struct {
+	sync.Mutex
+	m map[string]*Connection
+}{m: map[string]*Connection{}}
+
+// Connections returns a snapshot of the open TCP connections, keyed by
+// remote address.
+func Connections() map[string]Connection {
+	connections.Lock()
+	defer connections.Unlock()
+	snapshot := make(map[string]Connection, len(connections.m))
+	for addr, c := range connections.m {
+		snapshot[addr] = *c
+	}
+	return snapshot
+}
+
+// listenTLS builds the TLS config for the TCP listener, or returns nil if
+// TLS isn't configured.
+func listenTLS(config TCPConfig) (*tls.Config, error) {
+	if len(config.Cert) == 0 && len(config.Key) == 0 {
+		if len(config.ClientCA) > 0 {
+			return nil, errors.New("client_ca requires a cert and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(config.ClientCA) > 0 {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+/*
+ListenTCP takes collectd network packets over TCP, optionally secured with
+TLS, and breaks them into individual samples.
+
+Each packet on the stream is prefixed with its length as a big endian uint16,
+so packets can be as large as a collectd part can be.
+*/
+func ListenTCP(config ListenConfig, acl *ACL, normaliser *Normaliser, types *TypesDB, c chan collectd.Packet, notifications chan Notification) {
+	// Initialise the error counts
+	errorCounts.Add("listen.tcp.accept", 0)
+	errorCounts.Add("listen.tcp.read", 0)
+	errorCounts.Add("listen.tcp.handshake", 0)
+	listenCounts.Add("tcp.connections", 0)
+	listenCounts.Add("tcp.idle", 0)
+
+	tlsConfig, err := listenTLS(config.TCP)
+	if err != nil {
+		log.Fatalln("[fatal] ListenTCP: failed to set up TLS", err)
+	}
+
+	ln, err := net.Listen("tcp", config.TCP.Bind)
+	if err != nil {
+		log.Fatalln("[fatal] ListenTCP: failed to listen", err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	log.Printf("[info] ListenTCP: listening on %s (tls: %t)\n", config.TCP.Bind, tlsConfig != nil)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("[error] ListenTCP: Failed to accept connection", err)
+			errorCounts.Add("listen.tcp.accept", 1)
+			continue
+		}
+		if !acl.Allowed(addrIP(conn.RemoteAddr())) {
+			conn.Close()
+			continue
+		}
+		go handleTCP(config, acl, normaliser, types, conn, c, notifications)
+	}
+}
+
+// handleTCP reads length prefixed packets off a connection until it closes, or
+// goes idle for longer than the idle timeout.
+func handleTCP(config ListenConfig, acl *ACL, normaliser *Normaliser, types *TypesDB, conn net.Conn, c chan collectd.Packet, notifications chan Notification) {
+	defer conn.Close()
+
+	addr := conn.RemoteAddr().String()
+	stats := &Connection{Remote: addr, Connected: time.Now().Unix()}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println("[error] ListenTCP: TLS handshake failed with", addr, err)
+			errorCounts.Add("listen.tcp.handshake", 1)
+			return
+		}
+		stats.TLS = true
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			stats.Client = certs[0].Subject.CommonName
+		}
+	}
+
+	connections.Lock()
+	connections.m[addr] = stats
+	connections.Unlock()
+	listenCounts.Add("tcp.connections", 1)
+	defer func() {
+		connections.Lock()
+		delete(connections.m, addr)
+		connections.Unlock()
+		listenCounts.Add("tcp.connections", -1)
+	}()
+
+	timeout := config.TCP.idleTimeout()
+	header := make([]byte, 2)
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				log.Println("[info] ListenTCP: Closing idle connection from", addr)
+				listenCounts.Add("tcp.idle", 1)
+			} else if err != io.EOF {
+				log.Println("[error] ListenTCP: Failed to read from", addr, err)
+				errorCounts.Add("listen.tcp.read", 1)
+			}
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			log.Println("[error] ListenTCP: Failed to read from", addr, err)
+			errorCounts.Add("listen.tcp.read", 1)
+			return
+		}
+		listenCounts.Add("raw", 1)
+		listenCounts.Add("tcp.raw", 1)
+
+		connections.Lock()
+		stats.LastSeen = time.Now().Unix()
+		stats.Packets++
+		stats.Bytes += int64(len(buf))
+		connections.Unlock()
+
+		receive(config, acl, normaliser, types.Types(), conn.RemoteAddr(), buf, c, notifications)
+	}
+}
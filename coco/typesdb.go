@@ -0,0 +1,215 @@
+package coco
+
+import (
+	"errors"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// typesDBCheckInterval is how often types.db files are checked for changes.
+const typesDBCheckInterval = 5 * time.Second
+
+// TypesDB holds the types parsed from one or more types.db files, and reloads
+// them when the files change.
+type TypesDB struct {
+	paths  []string
+	types  atomic.Value
+	mtimes map[string]time.Time
+	mutex  sync.Mutex
+}
+
+// LoadTypesDB parses types.db files. Types in later files override types of
+// the same name in earlier files, like collectd's TypesDB option.
+func LoadTypesDB(paths []string) (*TypesDB, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no types.db files configured")
+	}
+	db := &TypesDB{paths: paths}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// WatchTypesDB loads the types.db files configured for Listen, and reloads
+// them when they change. Listen and the Api can share the TypesDB, so the files
+// are only loaded and watched once.
+func WatchTypesDB(config ListenConfig) (*TypesDB, error) {
+	// Initialise the reload counts
+	errorCounts.Add("listen.typesdb.reload", 0)
+	listenCounts.Add("typesdb.reloads", 0)
+
+	db, err := LoadTypesDB(config.typesdbs())
+	if err != nil {
+		return nil, err
+	}
+	go db.Watch(typesDBCheckInterval)
+	return db, nil
+}
+
+// Types returns the types from the most recent successful load.
+func (db *TypesDB) Types() collectd.Types {
+	return db.types.Load().(collectd.Types)
+}
+
+// Reload parses the types.db files again. If any of them can't be parsed,
+// the types from the last successful load are kept.
+func (db *TypesDB) Reload() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	types := collectd.Types{}
+	mtimes := map[string]time.Time{}
+	for _, path := range db.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		t, err := collectd.TypesDBFile(path)
+		if err != nil {
+			return err
+		}
+		for name, ds := range t {
+			types[name] = ds
+		}
+		mtimes[path] = info.ModTime()
+	}
+	db.types.Store(types)
+	db.mtimes = mtimes
+	return nil
+}
+
+// changed checks if any of the types.db files have been modified since they
+// were last loaded.
+func (db *TypesDB) changed() bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, path := range db.paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(db.mtimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the types.db files when they change, checking every
+// interval, or when Coco receives a SIGHUP.
+func (db *TypesDB) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(interval).C
+
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			if !db.changed() {
+				continue
+			}
+		}
+		if err := db.Reload(); err != nil {
+			log.Println("[error] TypesDB: failed to reload types.db:", err)
+			errorCounts.Add("listen.typesdb.reload", 1)
+			continue
+		}
+		log.Println("[info] TypesDB: reloaded", db.paths)
+		listenCounts.Add("typesdb.reloads", 1)
+	}
+}
+
+// UnknownType tracks samples received with a type that isn't in types.db.
+type UnknownType struct {
+	Count     int64            `json:"count"`
+	FirstSeen int64            `json:"first_seen"`
+	LastSeen  int64            `json:"last_seen"`
+	Hosts     map[string]int64 `json:"hosts"`
+}
+
+// Limits on how many unknown types, and hosts for each, are tracked.
+const (
+	maxUnknownTypes     = 1000
+	maxUnknownTypeHosts = 100
+)
+
+var unknownTypes = struct {
+	sync.Mutex
+	m map[string]*UnknownType
+}{m: map[string]*UnknownType{}}
+
+// UnknownTypes returns a snapshot of the unknown types that have been
+// received, keyed by type name.
+func UnknownTypes() map[string]UnknownType {
+	unknownTypes.Lock()
+	defer unknownTypes.Unlock()
+	snapshot := make(map[string]UnknownType, len(unknownTypes.m))
+	for name, u := range unknownTypes.m {
+		hosts := make(map[string]int64, len(u.Hosts))
+		for host, count := range u.Hosts {
+			hosts[host] = count
+		}
+		snapshot[name] = UnknownType{Count: u.Count, FirstSeen: u.FirstSeen, LastSeen: u.LastSeen, Hosts: hosts}
+	}
+	return snapshot
+}
+
+/*
+recordUnknownType tracks a sample with a type that isn't in types.db, and
+which host sent it.
+
+At most maxUnknownTypes types are tracked, forgetting the least recently seen
+to make room for another, and at most maxUnknownTypeHosts hosts for each type,
+forgetting the host that has sent the fewest samples.
+*/
+func recordUnknownType(packet collectd.Packet) {
+	now := time.Now().Unix()
+	listenCounts.Add("unknown_types", 1)
+
+	unknownTypes.Lock()
+	defer unknownTypes.Unlock()
+	u, ok := unknownTypes.m[packet.Type]
+	if !ok {
+		if len(unknownTypes.m) >= maxUnknownTypes {
+			forgetUnknownType()
+		}
+		u = &UnknownType{FirstSeen: now, Hosts: map[string]int64{}}
+		unknownTypes.m[packet.Type] = u
+	}
+	u.Count++
+	u.LastSeen = now
+	if _, ok := u.Hosts[packet.Hostname]; !ok && len(u.Hosts) >= maxUnknownTypeHosts {
+		forgetUnknownTypeHost(u)
+	}
+	u.Hosts[packet.Hostname]++
+}
+
+// forgetUnknownType stops tracking the least recently seen unknown type. The
+// unknownTypes lock must be held.
+func forgetUnknownType() {
+	var oldest *UnknownType
+	var oldestName string
+	for name, u := range unknownTypes.m {
+		if oldest == nil || u.LastSeen < oldest.LastSeen || (u.LastSeen == oldest.LastSeen && u.Count < oldest.Count) {
+			oldest, oldestName = u, name
+		}
+	}
+	delete(unknownTypes.m, oldestName)
+}
+
+// forgetUnknownTypeHost stops tracking the host that has sent the fewest
+// samples of an unknown type.
+func forgetUnknownTypeHost(u *UnknownType) {
+	var fewest string
+	for host, count := range u.Hosts {
+		if len(fewest) == 0 || count < u.Hosts[fewest] {
+			fewest = host
+		}
+	}
+	delete(u.Hosts, fewest)
+}
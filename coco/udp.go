@@ -0,0 +1,160 @@
+package coco
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// packetBuffers pools the buffers Listen receives datagrams into.
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, MaxPacketSize)
+	},
+}
+
+// listenUDPSockets binds n UDP sockets to the same address. More than one
+// socket requires SO_REUSEPORT, so the kernel can spread datagrams across
+// them.
+func listenUDPSockets(config ListenConfig, n int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	if n > 1 {
+		lc.Control = reusePort
+	}
+
+	var conns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", config.Bind)
+		if err != nil {
+			closeUDPSockets(conns)
+			return nil, fmt.Errorf("failed to listen: %s", err)
+		}
+		conn := pc.(*net.UDPConn)
+		conns = append(conns, conn)
+		if config.ReadBuffer > 0 {
+			if err := conn.SetReadBuffer(config.ReadBuffer); err != nil {
+				closeUDPSockets(conns)
+				return nil, fmt.Errorf("failed to set read buffer: %s", err)
+			}
+		}
+	}
+	return conns, nil
+}
+
+// closeUDPSockets closes sockets that won't be read from, so the kernel
+// doesn't spread datagrams to them.
+func closeUDPSockets(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// socketInode finds the inode of a socket, which identifies it in
+// /proc/net/udp.
+func socketInode(conn *net.UDPConn) (uint64, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var link string
+	var linkErr error
+	err = raw.Control(func(fd uintptr) {
+		link, linkErr = os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if linkErr != nil {
+		return 0, linkErr
+	}
+	// Links to sockets look like "socket:[12345]"
+	if !strings.HasPrefix(link, "socket:[") {
+		return 0, fmt.Errorf("unexpected socket link '%s'", link)
+	}
+	return strconv.ParseUint(strings.Trim(link[len("socket:"):], "[]"), 10, 64)
+}
+
+/*
+UDPSocketStats sums the receive queues and drop counts of the sockets with the
+given inodes, from the contents of /proc/net/udp or /proc/net/udp6:
+
+	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+	 0: 00000000:64E2 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12345 2 0000000000000000 42
+*/
+func UDPSocketStats(r io.Reader, inodes map[uint64]bool) (rxQueue int64, drops int64, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || !inodes[inode] {
+			continue
+		}
+		queues := strings.SplitN(fields[4], ":", 2)
+		if len(queues) != 2 {
+			return 0, 0, fmt.Errorf("unexpected queues '%s'", fields[4])
+		}
+		rx, err := strconv.ParseInt(queues[1], 16, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		d, err := strconv.ParseInt(fields[12], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		rxQueue += rx
+		drops += d
+	}
+	return rxQueue, drops, scanner.Err()
+}
+
+// watchDrops periodically exports the kernel's receive queue and drop counts
+// for Listen's sockets into coco.listen.
+func watchDrops(conns []*net.UDPConn) {
+	inodes := map[uint64]bool{}
+	for _, conn := range conns {
+		inode, err := socketInode(conn)
+		if err != nil {
+			log.Println("[info] Listen: not exporting kernel drop counts:", err)
+			return
+		}
+		inodes[inode] = true
+	}
+
+	rxQueue, drops := new(expvar.Int), new(expvar.Int)
+	listenCounts.Set("kernel.rx_queue", rxQueue)
+	listenCounts.Set("kernel.drops", drops)
+
+	for {
+		var totalQueue, totalDrops int64
+		for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+			f, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			q, d, err := UDPSocketStats(f, inodes)
+			f.Close()
+			if err != nil {
+				log.Printf("[error] Listen: Failed to read %s: %s\n", path, err)
+				continue
+			}
+			totalQueue += q
+			totalDrops += d
+		}
+		rxQueue.Set(totalQueue)
+		drops.Set(totalDrops)
+		time.Sleep(time.Second)
+	}
+}
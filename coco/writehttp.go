@@ -0,0 +1,282 @@
+package coco
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	collectd "github.com/kimor79/gollectd"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrPutval = errors.New("line is not 'PUTVAL identifier [interval=seconds] time:value[:value...]'")
+
+// ValueList is a sample in the JSON format sent by collectd's write_http
+// plugin. Undefined values are sent as null.
+type ValueList struct {
+	Values         []*float64 `json:"values"`
+	DSTypes        []string   `json:"dstypes"`
+	DSNames        []string   `json:"dsnames"`
+	Time           float64    `json:"time"`
+	Interval       float64    `json:"interval"`
+	Host           string     `json:"host"`
+	Plugin         string     `json:"plugin"`
+	PluginInstance string     `json:"plugin_instance"`
+	Type           string     `json:"type"`
+	TypeInstance   string     `json:"type_instance"`
+}
+
+// Packet converts a value list into a sample.
+func (v ValueList) Packet() (collectd.Packet, error) {
+	if len(v.Host) == 0 || len(v.Plugin) == 0 || len(v.Type) == 0 || len(v.Values) == 0 ||
+		len(v.Values) != len(v.DSTypes) || len(v.Values) != len(v.DSNames) {
+		return collectd.Packet{}, collectd.ErrorInvalid
+	}
+	packet := collectd.Packet{
+		Hostname:       v.Host,
+		Plugin:         v.Plugin,
+		PluginInstance: v.PluginInstance,
+		Type:           v.Type,
+		TypeInstance:   v.TypeInstance,
+		Time:           uint64(v.Time),
+		Interval:       uint64(v.Interval),
+	}
+	for i, value := range v.Values {
+		kind, ok := collectd.ValueTypeNames[v.DSTypes[i]]
+		if !ok {
+			return collectd.Packet{}, collectd.ErrorUnknownDataType
+		}
+		n := math.NaN()
+		if value != nil {
+			n = *value
+		} else if kind != collectd.TypeGauge {
+			// Only gauges can be undefined on the wire
+			return collectd.Packet{}, collectd.ErrorInvalid
+		}
+		packet.Values = append(packet.Values, collectd.Value{
+			Name:     v.DSNames[i],
+			Type:     kind,
+			TypeName: v.DSTypes[i],
+			Value:    n,
+		})
+	}
+	return packet, nil
+}
+
+// ParseWriteHTTP turns a write_http JSON payload into samples. A value list
+// that can't be converted is returned as nil, so it can be counted.
+func ParseWriteHTTP(body []byte) ([]*collectd.Packet, error) {
+	var lists []ValueList
+	if err := json.Unmarshal(body, &lists); err != nil {
+		return nil, err
+	}
+	packets := make([]*collectd.Packet, len(lists))
+	for i, list := range lists {
+		if p, err := list.Packet(); err == nil {
+			packets[i] = &p
+		}
+	}
+	return packets, nil
+}
+
+// splitIdentifier splits a "plugin-instance" or "type-instance" name.
+func splitIdentifier(name string) (string, string) {
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+/*
+ParsePutval turns a PUTVAL command, as sent by write_http in the command
+format, into samples:
+
+	PUTVAL "host/plugin-instance/type-instance" interval=10 1435639791:0.5
+
+The data sources for the type are looked up in types.db. A time of N is taken
+to be the current time, and U marks an undefined gauge.
+*/
+func ParsePutval(line string, types collectd.Types) ([]collectd.Packet, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "PUTVAL" {
+		return nil, ErrPutval
+	}
+
+	identifier := strings.Split(strings.Trim(fields[1], `"`), "/")
+	if len(identifier) != 3 || len(identifier[0]) == 0 {
+		return nil, ErrPutval
+	}
+	var template collectd.Packet
+	template.Hostname = identifier[0]
+	template.Plugin, template.PluginInstance = splitIdentifier(identifier[1])
+	template.Type, template.TypeInstance = splitIdentifier(identifier[2])
+	if len(template.Plugin) == 0 || len(template.Type) == 0 {
+		return nil, ErrPutval
+	}
+	datasets, ok := types[template.Type]
+	if !ok {
+		return nil, collectd.ErrorUnknownType
+	}
+
+	var packets []collectd.Packet
+	for _, field := range fields[2:] {
+		if strings.HasPrefix(field, "interval=") {
+			interval, err := strconv.ParseFloat(strings.TrimPrefix(field, "interval="), 64)
+			if err != nil {
+				return nil, ErrPutval
+			}
+			template.Interval = uint64(interval)
+			continue
+		}
+
+		values := strings.Split(field, ":")
+		if len(values) != len(datasets)+1 {
+			return nil, ErrPutval
+		}
+		packet := template
+		if values[0] == "N" {
+			packet.Time = uint64(time.Now().Unix())
+		} else {
+			t, err := strconv.ParseFloat(values[0], 64)
+			if err != nil || t < 0 {
+				return nil, ErrPutval
+			}
+			packet.Time = uint64(t)
+		}
+		for i, ds := range datasets {
+			n := math.NaN()
+			if values[i+1] != "U" || ds.Type != collectd.TypeGauge {
+				var err error
+				n, err = strconv.ParseFloat(values[i+1], 64)
+				if err != nil {
+					return nil, ErrPutval
+				}
+			}
+			packet.Values = append(packet.Values, collectd.Value{
+				Name:     ds.Name,
+				Type:     ds.Type,
+				TypeName: collectd.ValueTypeValues[ds.Type],
+				Value:    n,
+			})
+		}
+		packets = append(packets, packet)
+	}
+	if len(packets) == 0 {
+		return nil, ErrPutval
+	}
+	return packets, nil
+}
+
+/*
+WriteResult reports what happened to the samples in a write.
+
+Samples are counted as they're queued, before Normalise, Relabel, Clock, and
+Filter have seen them, so Denied is how many matched a deny rule as they were
+sent. Filter has the final say, and may drop samples that weren't denied here.
+*/
+type WriteResult struct {
+	// Samples queued for the rest of the pipeline
+	Queued int `json:"queued"`
+	// Queued samples that match a deny rule as they were sent
+	Denied int `json:"denied"`
+	// Samples dropped because the pipeline is full
+	Rejected int `json:"rejected"`
+	Invalid  int `json:"invalid"`
+}
+
+/*
+WriteHTTP handles samples posted by collectd's write_http plugin, in either
+the JSON format or the command format, depending on the Content-Type.
+
+Samples are queued for Normalise like samples received by Listen. The response
+reports how many were queued, how many of those match a deny rule before the
+pipeline rewrites them, how many were dropped because the pipeline is full, and
+how many couldn't be decoded. Writes never wait on a full pipeline, so a
+backlog can't tie up the Api.
+
+Writes are partial: if any samples were queued the response is a 200, so
+clients don't retry and duplicate them. Writes that queue nothing get a 400 if
+any samples couldn't be decoded, or a 503 if the pipeline was full.
+*/
+func WriteHTTP(w http.ResponseWriter, req *http.Request, types collectd.Types, rules Rules, raw chan collectd.Packet) {
+	respond := func(code int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		data, _ := json.Marshal(v)
+		w.Write(data)
+	}
+	if raw == nil {
+		respond(http.StatusServiceUnavailable, map[string]string{"error": "writes are not accepted in passthrough mode"})
+		return
+	}
+	listenCounts.Add("http.raw", 1)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		errorCounts.Add("listen.http.receive", 1)
+		respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var packets []*collectd.Packet
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		packets, err = ParseWriteHTTP(body)
+		if err != nil {
+			errorCounts.Add("listen.http.parse", 1)
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 {
+				continue
+			}
+			ps, err := ParsePutval(line, types)
+			if err != nil {
+				packets = append(packets, nil)
+				continue
+			}
+			for i := range ps {
+				packets = append(packets, &ps[i])
+			}
+		}
+	}
+
+	var result WriteResult
+	for _, p := range packets {
+		if p == nil {
+			errorCounts.Add("listen.http.parse", 1)
+			result.Invalid++
+			continue
+		}
+		listenCounts.Add("decoded", 1)
+		select {
+		case raw <- *p:
+			result.Queued++
+			if rules.denies(*p) {
+				result.Denied++
+			}
+		default:
+			errorCounts.Add("listen.http.full", 1)
+			result.Rejected++
+		}
+	}
+
+	code := http.StatusOK
+	switch {
+	case result.Queued > 0:
+	case result.Invalid > 0:
+		code = http.StatusBadRequest
+	case result.Rejected > 0:
+		code = http.StatusServiceUnavailable
+	}
+	respond(code, result)
+}
@@ -23,14 +23,28 @@ func main() {
 	}
 
 	// Setup data structures to be shared across components
-	blacklisted := map[string]map[string]int64{}
+	blacklisted := coco.NewBlacklisted()
 	raw := make(chan collectd.Packet, 1000000)
+	normalised := make(chan collectd.Packet, 1000000)
+	relabelled := make(chan collectd.Packet, 1000000)
+	clocked := make(chan collectd.Packet, 1000000)
 	filtered := make(chan collectd.Packet, 1000000)
+	deduped := make(chan collectd.Packet, 1000000)
 	items := make(chan coco.BlacklistItem, 1000000)
+	notifications := make(chan coco.Notification, 10000)
 
 	var tiers []coco.Tier
 	for k, v := range config.Tiers {
-		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tier := coco.Tier{
+			Name:          k,
+			Targets:       v.Targets,
+			SecurityLevel: v.SecurityLevel,
+			Username:      v.Username,
+			Password:      v.Password,
+			Include:       v.Include,
+			Exclude:       v.Exclude,
+			Limits:        config.Limits,
+		}
 		tiers = append(tiers, tier)
 	}
 
@@ -39,18 +53,58 @@ func main() {
 	}
 
 	chans := map[string]chan collectd.Packet{
-		"raw":      raw,
-		"filtered": filtered,
+		"raw":        raw,
+		"normalised": normalised,
+		"relabelled": relabelled,
+		"clocked":    clocked,
+		"filtered":   filtered,
+		"deduped":    deduped,
 		//"blacklist_items": items,
 	}
 	go coco.Measure(config.Measure, chans, &tiers)
 
+	// Listen normalises hostnames to check them against host_cidrs
+	normaliser, err := coco.NewNormaliser(config.Normalise)
+	if err != nil {
+		log.Fatalln("fatal:", err)
+	}
+
+	// Filter rules are shared by Filter and the Api, which can change them
+	rules, err := coco.NewRuleSet(config.Filter)
+	if err != nil {
+		log.Fatalln("fatal:", err)
+	}
+
+	// Hosts with skewed clocks are tracked by Clock, and reported by the Api
+	skews := coco.NewSkewTracker()
+
+	// types.db is shared by Listen and the Api, so it's only loaded once
+	var types *coco.TypesDB
+
 	// Launch components to do the work
-	go coco.Listen(config.Listen, raw)
-	for i := 0; i < 4; i++ {
-		go coco.Filter(config.Filter, raw, filtered, items)
+	if config.Listen.Passthrough {
+		go coco.Passthrough(config, rules, skews, &tiers, items)
+		// Samples can't be posted to the Api without Filter and Send running
+		raw = nil
+	} else {
+		types, err = coco.WatchTypesDB(config.Listen)
+		if err != nil {
+			log.Fatalln("fatal:", err)
+		}
+		go coco.Listen(config.Listen, normaliser, types, raw, notifications)
+		go coco.Normalise(config.Normalise, raw, normalised)
+		go coco.Relabel(config.Relabel, normalised, relabelled)
+		go coco.Clock(config.Clock, skews, relabelled, clocked)
+		for i := 0; i < 4; i++ {
+			go coco.Filter(rules, clocked, filtered, items)
+		}
+		if config.Dedup.Enabled {
+			go coco.Dedup(config.Dedup, filtered, deduped)
+			go coco.Send(config.Send, &tiers, deduped, notifications)
+		} else {
+			go coco.Send(config.Send, &tiers, filtered, notifications)
+		}
 	}
-	go coco.Blacklist(items, &blacklisted)
-	go coco.Send(&tiers, filtered)
-	coco.Api(config.Api, &tiers, &blacklisted)
+	go coco.Blacklist(config.Filter, items, blacklisted)
+	coco.Api(config, rules, skews, types, &tiers, blacklisted, raw)
 }
@@ -26,7 +26,10 @@ func errorJSON(err error) []byte {
 	return e
 }
 
-func Fetch(config coco.FetchConfig, tiers *[]coco.Tier) {
+// Fetch proxies requests for a host's data to the targets that store them.
+// Hostnames are normalised the same way Coco normalises them before hashing.
+func Fetch(cfg coco.Config, tiers *[]coco.Tier) {
+	config := cfg.Fetch
 	// Initialise the error counts
 	errorCounts.Add("fetch.con.get", 0)
 	errorCounts.Add("fetch.http.get", 0)
@@ -36,13 +39,19 @@ func Fetch(config coco.FetchConfig, tiers *[]coco.Tier) {
 		log.Fatal("[fatal] Fetch: No address configured to bind web server.")
 	}
 
+	normaliser, err := coco.NewNormaliser(cfg.Normalise)
+	if err != nil {
+		log.Fatalln("[fatal] Fetch:", err)
+	}
+
 	coco.BuildTiers(tiers)
 
 	m := martini.Classic()
 	m.Get("/data/:hostname/(.+)", func(params martini.Params, req *http.Request) []byte {
+		hostname := normaliser.Hostname(params["hostname"])
 		for _, tier := range *tiers {
 			// Lookup the hostname in the tier's hash. Work out where we should proxy to.
-			target, err := tier.Lookup(params["hostname"])
+			target, err := tier.Lookup(hostname)
 			if err != nil {
 				log.Printf("[info] Fetch: couldn't lookup target: %s\n", err)
 				defer func() { errorCounts.Add("fetch.con.get", 1) }()
@@ -57,7 +66,8 @@ func Fetch(config coco.FetchConfig, tiers *[]coco.Tier) {
 			} else {
 				host = strings.Split(target, ":")[0]
 			}
-			url := "http://" + host + req.RequestURI
+			uri := strings.Replace(req.RequestURI, "/data/"+params["hostname"], "/data/"+hostname, 1)
+			url := "http://" + host + uri
 			client := &http.Client{Timeout: config.Timeout()}
 			resp, err := client.Get(url)
 			defer resp.Body.Close()
@@ -121,7 +131,7 @@ func Fetch(config coco.FetchConfig, tiers *[]coco.Tier) {
 		coco.ExpvarHandler(w, r)
 	})
 	m.Get("/lookup", func(params martini.Params, req *http.Request) []byte {
-		return coco.TierLookup(params, req, tiers)
+		return coco.TierLookup(params, req, tiers, normaliser)
 	})
 
 	log.Printf("[info] Fetch: binding web server to %s", config.Bind)
@@ -80,7 +80,7 @@ func TestFetch(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
-	go noodle.Fetch(fetchConfig, &tiers)
+	go noodle.Fetch(coco.Config{Fetch: fetchConfig}, &tiers)
 
 	poll(t, fetchConfig.Bind)
 
@@ -127,7 +127,7 @@ func TestFetchHasTargetMetadata(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
-	go noodle.Fetch(fetchConfig, &tiers)
+	go noodle.Fetch(coco.Config{Fetch: fetchConfig}, &tiers)
 
 	poll(t, fetchConfig.Bind)
 
@@ -178,7 +178,7 @@ func TestFetchWithFailure(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
-	go noodle.Fetch(fetchConfig, &tiers)
+	go noodle.Fetch(coco.Config{Fetch: fetchConfig}, &tiers)
 
 	poll(t, fetchConfig.Bind)
 
@@ -218,7 +218,7 @@ func TestTierLookup(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
-	go noodle.Fetch(fetchConfig, &tiers)
+	go noodle.Fetch(coco.Config{Fetch: fetchConfig}, &tiers)
 
 	poll(t, fetchConfig.Bind)
 
@@ -260,7 +260,7 @@ func TestExpvars(t *testing.T) {
 		tiers = append(tiers, tier)
 	}
 
-	go noodle.Fetch(fetchConfig, &tiers)
+	go noodle.Fetch(coco.Config{Fetch: fetchConfig}, &tiers)
 
 	poll(t, fetchConfig.Bind)
 
@@ -285,3 +285,112 @@ func TestExpvars(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// lookupTarget finds the target a hostname is hashed to in a tier
+func lookupTarget(t *testing.T, targets []string, name string) string {
+	tiers := []coco.Tier{coco.Tier{Name: "a", Targets: targets}}
+	coco.BuildTiers(&tiers)
+	target, err := tiers[0].Lookup(name)
+	if err != nil {
+		t.Fatalf("Couldn't lookup %s: %s", name, err)
+	}
+	return target
+}
+
+// Variants of web01.example.org, at least one of which is hashed to a
+// different target than web01.example.org itself
+var hostnameVariants = []string{"WEB01.example.org", "web01.example.org.", "Web01.Example.Org", "WEB01.EXAMPLE.ORG."}
+
+// hashedApart checks at least one variant is hashed to a different target
+// than the normalised hostname, so normalising is needed to find it
+func hashedApart(t *testing.T, targets []string) {
+	expected := lookupTarget(t, targets, "web01.example.org")
+	for _, name := range hostnameVariants {
+		if lookupTarget(t, targets, name) != expected {
+			return
+		}
+	}
+	t.Fatalf("Expected a variant of web01.example.org to be hashed away from %s", expected)
+}
+
+// Test hostnames are normalised before looking up where they're stored
+func TestTierLookupNormalises(t *testing.T) {
+	// Setup Fetch
+	fetchConfig := coco.FetchConfig{
+		Bind:         "127.0.0.1:26085",
+		ProxyTimeout: *new(coco.Duration),
+	}
+	fetchConfig.ProxyTimeout.UnmarshalText([]byte("3s"))
+	normaliseConfig := coco.NormaliseConfig{Lowercase: true, TrimDot: true}
+
+	targets := []string{"127.0.0.1:25887", "127.0.0.1:25888", "127.0.0.1:25889"}
+	var tiers []coco.Tier
+	tiers = append(tiers, coco.Tier{Name: "a", Targets: targets})
+
+	go noodle.Fetch(coco.Config{Fetch: fetchConfig, Normalise: normaliseConfig}, &tiers)
+
+	poll(t, fetchConfig.Bind)
+
+	// Test every variant of a hostname is found where the normalised hostname
+	// is stored
+	hashedApart(t, targets)
+	expected := lookupTarget(t, targets, "web01.example.org")
+	for _, name := range append([]string{"web01.example.org"}, hostnameVariants...) {
+		resp, err := http.Get("http://" + fetchConfig.Bind + "/lookup?name=" + name)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %s", err)
+		}
+		var result map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Error when decoding JSON %+v", err)
+		}
+		if result["a"] != expected {
+			t.Errorf("Expected %s to be stored on %s, got %s", name, expected, result["a"])
+		}
+	}
+}
+
+// Test hostnames are normalised before fetching data from where they're stored
+func TestFetchNormalises(t *testing.T) {
+	go MockVisage()
+
+	// Setup Fetch
+	fetchConfig := coco.FetchConfig{
+		Bind:         "127.0.0.1:26086",
+		ProxyTimeout: *new(coco.Duration),
+		RemotePort:   "29292",
+	}
+	fetchConfig.ProxyTimeout.UnmarshalText([]byte("3s"))
+	normaliseConfig := coco.NormaliseConfig{Lowercase: true, TrimDot: true}
+
+	targets := []string{"127.0.0.1:25887", "127.0.0.1:25888", "127.0.0.1:25889"}
+	var tiers []coco.Tier
+	tiers = append(tiers, coco.Tier{Name: "a", Targets: targets})
+
+	go noodle.Fetch(coco.Config{Fetch: fetchConfig, Normalise: normaliseConfig}, &tiers)
+
+	poll(t, fetchConfig.Bind)
+
+	// Test
+	hashedApart(t, targets)
+	expected := lookupTarget(t, targets, "web01.example.org")
+	for _, name := range hostnameVariants {
+		resp, err := http.Get("http://" + fetchConfig.Bind + "/data/" + name + "/load/load")
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %s", err)
+		}
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Error when decoding JSON %+v", err)
+		}
+
+		// The target is asked for the normalised hostname
+		if _, ok := result["web01.example.org"]; !ok {
+			t.Errorf("Expected data for %s to be fetched as web01.example.org, got %+v", name, result)
+		}
+		meta, _ := result["_meta"].(map[string]interface{})
+		if meta["target"] != expected {
+			t.Errorf("Expected %s to be fetched from %s, got %v", name, expected, meta["target"])
+		}
+	}
+}
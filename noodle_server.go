@@ -24,7 +24,7 @@ func main() {
 
 	var tiers []coco.Tier
 	for k, v := range config.Tiers {
-		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tier := coco.Tier{Name: k, Targets: v.Targets, Include: v.Include, Exclude: v.Exclude}
 		tiers = append(tiers, tier)
 	}
 
@@ -32,5 +32,5 @@ func main() {
 		log.Fatal("No tiers configured. Exiting.")
 	}
 
-	noodle.Fetch(config.Fetch, &tiers)
+	noodle.Fetch(config, &tiers)
 }